@@ -33,15 +33,65 @@ package agi
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Session is a struct holding AGI environment vars and the I/O handlers.
 type Session struct {
-	Env map[string]string //AGI environment variables.
-	buf *bufio.ReadWriter //AGI I/O buffer.
+	Env     map[string]string //AGI environment variables.
+	EnvMax  int               //Maximum number of AGI environment variables accepted by Init, 150 if zero.
+	buf     *bufio.ReadWriter //AGI I/O buffer.
+	ctx     context.Context   //Session lifetime context.
+	conn    net.Conn          //Underlying network connection, if known.
+	dl      *deadlineRW       //Deadline enforcing I/O adapter, used when conn is not available.
+	mu      sync.Mutex        //Guards buf against concurrent use by the hangup poller.
+	hangup  chan struct{}     //Closed when a HANGUP request is detected.
+	polling bool              //Hangup poller is running.
+	closed  bool              //Session has ended, stops the hangup poller.
+	logger  Logger            //Command-level tracing logger.
+	raw200  *string           //If set, receives the raw text of the next 200 reply.
+	metrics Metrics           //Measurements collector, set by Server.
+	pipe    *[]string         //If set, commands are recorded here instead of being sent.
+	dead    int32             //Atomic flag, a 511 reply was received, the channel is dead.
+	trace   *traceRW          //Protocol trace, set by Trace.
+	onHup   func()            //Called when a HANGUP request is detected.
+	limiter *rateLimiter      //If set, limits the rate of AGI commands.
+	hooks   Hooks             //Event hooks, set by SetHooks.
+	histCap int               //Capacity of the command history, set by WithHistoryCapacity.
+	history *commandHistory   //Recent AGI commands, if enabled.
+
+	deadline   time.Time     //Session I/O deadline.
+	cmdTimeout time.Duration //Maximum duration of each AGI command.
+	startTime  time.Time     //Session initialization time.
+	cmdCount   int           //Number of AGI commands sent.
+
+	idleTimeout time.Duration //Maximum duration between AGI commands, set by Server.
+	idleTimer   *time.Timer   //Closes the connection when idleTimeout elapses.
+
+	retries      int           //Maximum number of retries of commands failing with a 520 response.
+	retryBackoff time.Duration //Maximum delay between retries.
+	checking     int32         //Atomic flag, a Server health check is in progress.
+}
+
+// Logger is the interface of the logger used for command-level tracing of a Session.
+// It is satisfied by *slog.Logger. Arguments are alternating key/value pairs.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
 }
 
 // Reply is a struct that holds the return values of each AGI command.
@@ -50,10 +100,13 @@ type Reply struct {
 	Dat string //Additional returned data.
 }
 
-// New creates a new Session and returns a pointer to it.
-func New() *Session {
+// New creates a new Session, configured by the given options, and returns a pointer to it.
+func New(opts ...Option) *Session {
 	a := new(Session)
 	a.Env = make(map[string]string, envMin+5)
+	for _, opt := range opts {
+		opt(a)
+	}
 	return a
 }
 
@@ -61,13 +114,353 @@ func New() *Session {
 // and output (stdout) for a standalone AGI application. It reads and stores the AGI environment
 // variables in Env. Returns an error if the parsing of the AGI environment was unsuccessful.
 func (a *Session) Init(rw *bufio.ReadWriter) error {
+	a.initIO(rw)
+	err := a.parseEnv()
+	return err
+}
+
+// InitWithTimeout initializes a new AGI session like Init, failing if the AGI environment is not
+// received within timeout. The timeout is enforced on the network connection for sessions that
+// know it, otherwise the session I/O is wrapped by an adapter that enforces it.
+func (a *Session) InitWithTimeout(rw *bufio.ReadWriter, timeout time.Duration) error {
+	a.initIO(rw)
+	if err := a.setIODeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	err := a.parseEnv()
+	if derr := a.setIODeadline(a.deadline); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// initIO sets up the session I/O on rw, or on stdin and stdout if rw is nil.
+func (a *Session) initIO(rw *bufio.ReadWriter) {
 	if rw == nil {
 		a.buf = bufio.NewReadWriter(bufio.NewReader(os.Stdin), bufio.NewWriter(os.Stdout))
 	} else {
 		a.buf = rw
 	}
-	err := a.parseEnv()
-	return err
+	a.hangup = make(chan struct{})
+	a.startTime = time.Now()
+	a.initHistory()
+	a.wrapTrace()
+}
+
+// initHistory preallocates the command history, if enabled.
+func (a *Session) initHistory() {
+	a.history = nil
+	if a.histCap > 0 {
+		a.history = newCommandHistory(a.histCap)
+	}
+}
+
+// InitRW initializes a new AGI session like Init, reading from r and writing to w.
+// Both are buffered internally, e.g. a net.Conn can be passed as both r and w.
+func (a *Session) InitRW(r io.Reader, w io.Writer) error {
+	return a.Init(bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(w)))
+}
+
+// InitConn initializes a new FastAGI session on the network connection c like Init.
+// The connection is kept, so that SetDeadline and SetCommandTimeout set its deadlines directly.
+func (a *Session) InitConn(c net.Conn) error {
+	a.conn = c
+	return a.InitRW(c, c)
+}
+
+// InitContext initializes a new AGI session like Init, binding the session lifetime to ctx.
+// Once ctx is cancelled or its deadline expires every AGI command fails with an error wrapping
+// ctx.Err(), including commands already waiting for a reply, and reads or writes on the
+// underlying connection are refused.
+func (a *Session) InitContext(ctx context.Context, rw *bufio.ReadWriter) error {
+	if rw == nil {
+		rw = bufio.NewReadWriter(bufio.NewReader(os.Stdin), bufio.NewWriter(os.Stdout))
+	}
+	a.ctx = ctx
+	a.buf = bufio.NewReadWriter(
+		bufio.NewReader(ctxReader{ctx, rw}),
+		bufio.NewWriter(ctxWriter{ctx, rw}),
+	)
+	a.hangup = make(chan struct{})
+	a.startTime = time.Now()
+	a.initHistory()
+	a.wrapTrace()
+	return a.parseEnv()
+}
+
+// SetDeadline sets the read and write deadline of the AGI session. A zero value for d means
+// commands will not time out. Once the deadline is exceeded, commands fail with an error
+// that wraps os.ErrDeadlineExceeded instead of blocking while waiting for a reply.
+// The deadline is set on the underlying network connection for FastAGI sessions created by Server,
+// otherwise the session I/O is wrapped by an adapter that enforces it.
+func (a *Session) SetDeadline(d time.Time) error {
+	a.deadline = d
+	return a.setIODeadline(d)
+}
+
+// WithRetry makes the session retry commands that fail with Err520Response up to maxRetries times,
+// with an exponential backoff starting at 10ms and capped at backoff. Commands failing with other
+// errors, including 510 (unknown command) and 511 (dead channel), are not retried. If all retries
+// are exhausted the last error is returned. It returns a for chaining, e.g. agi.New().WithRetry(2, time.Second).
+func (a *Session) WithRetry(maxRetries int, backoff time.Duration) *Session {
+	a.retries = maxRetries
+	a.retryBackoff = backoff
+	return a
+}
+
+// SetCommandTimeout sets the maximum time each AGI command may take to get its reply. If Asterisk
+// doesn't reply within d the command fails with an error that wraps os.ErrDeadlineExceeded.
+// The timeout applies on top of any deadline set with SetDeadline. Zero means no timeout.
+func (a *Session) SetCommandTimeout(d time.Duration) {
+	a.cmdTimeout = d
+}
+
+// setIODeadline sets the deadline of the session I/O.
+func (a *Session) setIODeadline(d time.Time) error {
+	if a.conn != nil {
+		return a.conn.SetDeadline(d)
+	}
+	if a.buf == nil {
+		return fmt.Errorf("session not initialized")
+	}
+	if a.dl == nil {
+		a.dl = &deadlineRW{rw: a.buf}
+		a.buf = bufio.NewReadWriter(bufio.NewReader(a.dl), bufio.NewWriter(a.dl))
+	}
+	a.dl.deadline = d
+	return nil
+}
+
+// CommandCount returns the number of AGI commands sent during the session.
+func (a *Session) CommandCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cmdCount
+}
+
+// ElapsedTime returns the time elapsed since the session was initialized.
+func (a *Session) ElapsedTime() time.Duration {
+	if a.startTime.IsZero() {
+		return 0
+	}
+	return time.Since(a.startTime)
+}
+
+// Trace echoes the raw protocol data of the session to w, every line read from asterisk
+// and every line written to it, including the AGI environment if called before Init.
+// Calling Trace(nil) stops tracing.
+func (a *Session) Trace(w io.Writer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.trace != nil {
+		a.trace.w = w
+		return
+	}
+	if w == nil {
+		return
+	}
+	a.trace = &traceRW{w: w}
+	if a.buf != nil {
+		a.wrapTrace()
+	}
+}
+
+// wrapTrace wraps the session I/O with the trace writer, if one is set.
+func (a *Session) wrapTrace() {
+	if a.trace == nil {
+		return
+	}
+	a.trace.rw = a.buf
+	a.buf = bufio.NewReadWriter(bufio.NewReader(a.trace), bufio.NewWriter(a.trace))
+}
+
+// RemoteAddr returns the network address of the asterisk end of a FastAGI session, as reported
+// by the PROXY protocol header when Server.ProxyProtocol is enabled. It returns nil for sessions
+// not served by Server.
+func (a *Session) RemoteAddr() net.Addr {
+	if a.conn == nil {
+		return nil
+	}
+	return a.conn.RemoteAddr()
+}
+
+// IsAlive reports whether the channel is still up. It first checks for a HANGUP request already
+// received and otherwise sends a NOOP command, so it costs a network round-trip and should not be
+// called in tight loops, HangupChan is better suited for watching for hangups. Errors other than
+// a hangup or a dead channel are returned.
+func (a *Session) IsAlive() (bool, error) {
+	a.mu.Lock()
+	if a.buf != nil {
+		if a.buf.Reader.Buffered() == 0 && a.setIODeadline(earliest(time.Now().Add(hangupPollTimeout), a.deadline)) == nil {
+			// Nothing reads from the connection between commands, wait briefly for data to arrive.
+			a.buf.Reader.Peek(1)
+			a.setIODeadline(a.deadline)
+		}
+		if n := a.buf.Reader.Buffered(); n > 0 {
+			if line, _ := a.buf.Reader.Peek(n); bytes.HasPrefix(line, []byte("HANGUP\n")) {
+				a.setHangup()
+			}
+		}
+	}
+	dead := atomic.LoadInt32(&a.dead) != 0
+	a.mu.Unlock()
+	if dead || a.hungUp() {
+		return false, nil
+	}
+	_, err := a.Noop()
+	if errors.Is(err, ErrHangupResponse) || errors.Is(err, Err511Response) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// IsDead reports whether the channel is dead, that is a command was rejected with a 511 reply.
+// No further commands are sent on a dead channel, they fail with a DeadChannelError instead.
+func (a *Session) IsDead() bool {
+	return atomic.LoadInt32(&a.dead) != 0
+}
+
+// SetLogger sets the logger used for command-level tracing. Every AGI command sent and every
+// reply line received is logged at debug level, along with a session_id key holding the session's
+// unique ID when available. A nil l disables logging.
+func (a *Session) SetLogger(l Logger) {
+	a.logger = l
+}
+
+// logDebug logs a debug message, adding the session_id key if the unique ID is known.
+func (a *Session) logDebug(msg string, args ...interface{}) {
+	if a.logger == nil {
+		return
+	}
+	if id := a.Env["uniqueid"]; id != "" {
+		args = append([]interface{}{"session_id", id}, args...)
+	}
+	a.logger.Debug(msg, args...)
+}
+
+// HangupChan returns a channel that is closed the first time a HANGUP request from asterisk
+// is detected, letting callers select on it alongside their own logic. Hangups are detected while
+// sending commands and reading their replies. The first call also starts a background goroutine
+// that periodically reads from the connection, for a few milliseconds while no command is in
+// progress, to detect HANGUP requests received in between, until a hangup is detected, the
+// session context is done or the session is closed by Server. It must be called after Init.
+func (a *Session) HangupChan() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.hangup == nil {
+		a.hangup = make(chan struct{})
+	}
+	if !a.polling && a.buf != nil {
+		a.polling = true
+		go a.pollHangup(a.hangup)
+	}
+	return a.hangup
+}
+
+// pollHangup periodically reads from the connection and checks for a pending HANGUP request.
+func (a *Session) pollHangup(hangup chan struct{}) {
+	var done <-chan struct{}
+	if a.ctx != nil {
+		done = a.ctx.Done()
+	}
+	t := time.NewTicker(hangupPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-hangup:
+			return
+		case <-done:
+			return
+		case <-t.C:
+		}
+		a.mu.Lock()
+		if a.hangup != hangup {
+			a.mu.Unlock()
+			return
+		}
+		if a.closed || a.buf == nil {
+			a.polling = false
+			a.mu.Unlock()
+			return
+		}
+		if a.buf.Reader.Buffered() == 0 && a.setIODeadline(earliest(time.Now().Add(hangupPollTimeout), a.deadline)) == nil {
+			// Nothing reads from the connection between commands, wait briefly for data to arrive.
+			a.buf.Reader.Peek(1)
+			a.setIODeadline(a.deadline)
+		}
+		if n := a.buf.Reader.Buffered(); n > 0 {
+			if line, _ := a.buf.Reader.Peek(n); bytes.HasPrefix(line, []byte("HANGUP\n")) {
+				a.setHangup()
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// setHangup closes the hangup channel if it isn't already closed.
+func (a *Session) setHangup() {
+	if a.hangup == nil {
+		return
+	}
+	select {
+	case <-a.hangup:
+	default:
+		close(a.hangup)
+		if a.metrics != nil {
+			a.metrics.HangupReceived()
+		}
+		if a.onHup != nil {
+			go a.onHup()
+		}
+		if a.hooks.OnHangup != nil {
+			go a.hooks.OnHangup()
+		}
+	}
+}
+
+// hungUp reports whether a HANGUP request has been detected.
+func (a *Session) hungUp() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.hangup == nil {
+		return false
+	}
+	select {
+	case <-a.hangup:
+		return true
+	default:
+		return false
+	}
+}
+
+// close marks the end of the session.
+func (a *Session) close() {
+	a.mu.Lock()
+	a.closed = true
+	if a.idleTimer != nil {
+		a.idleTimer.Stop()
+	}
+	a.mu.Unlock()
+}
+
+// Destroy ends the session, releasing its I/O buffer and clearing Env. The channel returned by
+// HangupChan is closed, waking up any goroutines waiting on it. After Destroy every AGI command
+// fails, the underlying connection is not closed and remains the responsibility of the caller.
+func (a *Session) Destroy() {
+	a.close()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buf = nil
+	for k := range a.Env {
+		delete(a.Env, k)
+	}
+	if a.hangup != nil {
+		select {
+		case <-a.hangup:
+		default:
+			close(a.hangup)
+		}
+	}
 }
 
 // Answer answers channel. Res is -1 on channel failure, or 0 if successful.
@@ -91,6 +484,7 @@ func (a *Session) AsyncagiBreak() (Reply, error) {
 //     5 - Remote end is ringing.
 //     6 - Line is up.
 //     7 - Line is busy.
+// Use Reply.ChannelState to get the result as a ChannelState.
 func (a *Session) ChannelStatus(channel ...string) (Reply, error) {
 	if channel != nil {
 		return a.sendMsg(fmt.Sprintf("CHANNEL STATUS %q", channel[0]))
@@ -102,12 +496,44 @@ func (a *Session) ChannelStatus(channel ...string) (Reply, error) {
 // Optional parameters: skipms, ffchar - Defaults to *, rewchr - Defaults to #, pausechr.
 // Res is 0 if playback completes without a digit being pressed, or the ASCII numerical value
 // of the digit if one was pressed, or -1 on error or if the channel was disconnected.
+// Dat contains the decimal sample offset where playback stopped, see Reply.EndPos.
 func (a *Session) ControlStreamFile(file, escape string, params ...interface{}) (Reply, error) {
 	cmd := fmt.Sprintf("%q %q", file, escape)
 	for _, par := range params {
 		cmd = fmt.Sprintf("%s \"%v\"", cmd, par)
 	}
-	return a.sendMsg(fmt.Sprintf("CONTROL STREAM FILE %s", cmd))
+	r, err := a.sendMsg(fmt.Sprintf("CONTROL STREAM FILE %s", cmd))
+	if r.Dat != "" {
+		r.Dat = strings.TrimPrefix(r.Dat, "endpos=")
+	}
+	return r, err
+}
+
+// ControlStreamOptions holds the optional parameters of ControlStreamFileWithOptions.
+// Zero values fall back to asterisk's defaults: 3000ms skip, * to fast forward,
+// # to rewind and no pause digit.
+type ControlStreamOptions struct {
+	SkipMS    int    //Milliseconds to skip when fast forwarding or rewinding.
+	FFChar    string //Digit that fast forwards.
+	RewChar   string //Digit that rewinds.
+	PauseChar string //Digit that pauses and resumes playback.
+}
+
+// ControlStreamFileWithOptions sends audio file on channel and allows the listener to control
+// the stream like ControlStreamFile, with the optional parameters given in opts.
+func (a *Session) ControlStreamFileWithOptions(file, escape string, opts ControlStreamOptions) (Reply, error) {
+	params := []interface{}{opts.SkipMS, opts.FFChar, opts.RewChar, opts.PauseChar}
+	defaults := []interface{}{3000, "*", "#", ""}
+	n := len(params)
+	for n > 0 && (params[n-1] == 0 || params[n-1] == "") {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		if params[i] == 0 || params[i] == "" {
+			params[i] = defaults[i]
+		}
+	}
+	return a.ControlStreamFile(file, escape, params[:n]...)
 }
 
 // DatabaseDel removes database key/value. Res is 1 if successful, 0 otherwise.
@@ -160,6 +586,39 @@ func (a *Session) GetData(file string, params ...int) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("GET DATA %s", cmd))
 }
 
+// GetDataDuration prompts for DTMF on a channel like GetData, waiting up to timeout for input.
+// Optional parameter maxdigits. A negative timeout is invalid and returns an error.
+func (a *Session) GetDataDuration(file string, timeout time.Duration, maxdigits ...int) (Reply, error) {
+	if timeout < 0 {
+		return Reply{}, fmt.Errorf("invalid timeout: %v", timeout)
+	}
+	return a.GetData(file, append([]int{millis(timeout)}, maxdigits...)...)
+}
+
+// GetDataTyped prompts for DTMF on a channel like GetData and returns the collected digits as a
+// GetDataResult. Unlike the numeric Res of GetData, Digits preserves leading zeros and non numeric
+// digits, and empty input is reported without an error.
+func (a *Session) GetDataTyped(file string, params ...int) (GetDataResult, error) {
+	var raw string
+	a.raw200 = &raw
+	_, err := a.GetData(file, params...)
+	a.raw200 = nil
+	if !strings.HasPrefix(raw, "result=") {
+		if err == nil {
+			err = ErrMalformed200Response{raw}
+		}
+		return GetDataResult{}, err
+	}
+	res, dat := strings.TrimPrefix(raw, "result="), ""
+	if i := strings.IndexByte(res, ' '); i >= 0 {
+		res, dat = res[:i], res[i+1:]
+	}
+	if res == "-1" {
+		return GetDataResult{}, errors.New("failed to get data")
+	}
+	return GetDataResult{Digits: res, Timeout: dat == "(timeout)"}, nil
+}
+
 // GetFullVariable evaluates a channel expression, if no channel is specified the current channel is used.
 // Res is 1 if variable is set and the value is returned in Dat.
 // Understands complex variable names and build in variables.
@@ -178,6 +637,16 @@ func (a *Session) GetFullVariable(variable string, channel ...string) (Reply, er
 	return r, err
 }
 
+// GetFullVariableExpr gets a channel variable like GetFullVariable, wrapping name in ${} unless
+// it is already wrapped. If no channel is specified the current channel is used.
+// Res is 1 if variable is set and the value is returned in Dat.
+func (a *Session) GetFullVariableExpr(name string, channel ...string) (Reply, error) {
+	if !strings.HasPrefix(name, "${") || !strings.HasSuffix(name, "}") {
+		name = "${" + name + "}"
+	}
+	return a.GetFullVariable(name, channel...)
+}
+
 // GetOption streams file, prompts for DTMF with timeout. Optional parameter: timeout.
 // Res contains the digits received from the channel at the other end and Dat
 // contains the sample ofset. In case of failure to playback Res is -1.
@@ -195,6 +664,22 @@ func (a *Session) GetOption(filename, escape string, timeout ...int) (Reply, err
 	return r, err
 }
 
+// GetOptionWithTimeout streams file and prompts for DTMF like GetOption, waiting up to timeout
+// for input. The timeout is always sent, so a zero timeout doesn't wait at all. A negative
+// timeout is invalid and returns an error. Use Reply.EndPos to get the sample offset.
+func (a *Session) GetOptionWithTimeout(filename, escape string, timeout time.Duration) (Reply, error) {
+	if timeout < 0 {
+		return Reply{}, fmt.Errorf("invalid timeout: %v", timeout)
+	}
+	return a.GetOption(filename, escape, millis(timeout))
+}
+
+// GetOptionNoTimeout streams file and prompts for DTMF like GetOption, without sending a timeout,
+// so asterisk uses the default digit timeout of the dialplan. Use Reply.EndPos to get the sample offset.
+func (a *Session) GetOptionNoTimeout(filename, escape string) (Reply, error) {
+	return a.GetOption(filename, escape)
+}
+
 // GetVariable gets a channel variable. Res is 0 if variable is not set,
 // 1 if variable is set and Dat contains the value.
 func (a *Session) GetVariable(variable string) (Reply, error) {
@@ -206,12 +691,59 @@ func (a *Session) GetVariable(variable string) (Reply, error) {
 	return r, err
 }
 
+// GetVariableInt gets a channel variable and parses it as a base 10 integer. It returns an
+// ErrVariableNotSet error if the variable is not set, or the parsing error if it isn't an integer.
+func (a *Session) GetVariableInt(name string) (int64, error) {
+	r, err := a.GetVariable(name)
+	if err != nil {
+		return 0, err
+	}
+	if r.Res == 0 {
+		return 0, ErrVariableNotSet{name}
+	}
+	return strconv.ParseInt(r.Dat, 10, 64)
+}
+
+// GetVariableBool gets a channel variable and parses it as a boolean, accepting the values
+// of strconv.ParseBool like 1, 0, true and false. It returns an ErrVariableNotSet error if
+// the variable is not set, or the parsing error if it isn't a boolean.
+func (a *Session) GetVariableBool(name string) (bool, error) {
+	r, err := a.GetVariable(name)
+	if err != nil {
+		return false, err
+	}
+	if r.Res == 0 {
+		return false, ErrVariableNotSet{name}
+	}
+	return strconv.ParseBool(r.Dat)
+}
+
 // GoSub causes the channel to execute the specified dialplan subroutine, returning to the dialplan
-// with execution of a Return().
+// with execution of a Return(). The value passed to Return() is stored in the GOSUB_RETVAL
+// channel variable, see GoSubReturnValue.
 func (a *Session) GoSub(context, extension, priority, args string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("GOSUB %q %q %q %q", context, extension, priority, args))
 }
 
+// GoSubNoArgs executes the specified dialplan subroutine like GoSub, without passing any arguments.
+func (a *Session) GoSubNoArgs(context, extension, priority string) (Reply, error) {
+	return a.GoSub(context, extension, priority, "")
+}
+
+// GoSubReturnValue returns the value passed to Return() by the last dialplan subroutine executed
+// with GoSub, as stored in the GOSUB_RETVAL channel variable. It returns an ErrVariableNotSet
+// error if the variable is not set.
+func (a *Session) GoSubReturnValue() (string, error) {
+	r, err := a.GetVariable("GOSUB_RETVAL")
+	if err != nil {
+		return "", err
+	}
+	if r.Res == 0 {
+		return "", ErrVariableNotSet{"GOSUB_RETVAL"}
+	}
+	return r.Dat, nil
+}
+
 // Hangup hangs up a channel, Res is 1 on success, -1 if the given channel was not found.
 func (a *Session) Hangup(channel ...string) (Reply, error) {
 	var r Reply
@@ -225,6 +757,20 @@ func (a *Session) Hangup(channel ...string) (Reply, error) {
 	return r, err
 }
 
+// Ping checks that the session is alive by sending a NOOP command, waiting up to timeout for
+// the reply instead of the command timeout of the session. Any error, including a timeout or
+// a hangup, indicates that the session should be torn down. Unlike IsAlive it doesn't check for
+// pending HANGUP requests first and it is not subject to WithRetry. The NOOP is not counted by
+// CommandCount, recorded in the history, passed to hooks or metrics, and it doesn't reset the
+// Server IdleTimeout, so health checks don't keep idle sessions alive.
+func (a *Session) Ping(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("invalid timeout: %v", timeout)
+	}
+	_, err := a.send("NOOP", timeout, false)
+	return err
+}
+
 // Noop does nothing. Res is always 0.
 func (a *Session) Noop(params ...interface{}) (Reply, error) {
 	var cmd string
@@ -252,6 +798,15 @@ func (a *Session) ReceiveChar(timeout int) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("RECEIVE CHAR %d", timeout))
 }
 
+// ReceiveCharDuration receives one character like ReceiveChar, waiting up to d. A zero d waits
+// indefinitely, a negative one is invalid and returns an error. Use ReceiveCharResult to interpret the Reply.
+func (a *Session) ReceiveCharDuration(d time.Duration) (Reply, error) {
+	if d < 0 {
+		return Reply{}, fmt.Errorf("invalid timeout: %v", d)
+	}
+	return a.ReceiveChar(millis(d))
+}
+
 // ReceiveText receives text from channels supporting it. Res is -1 for failure
 // or 1 for success, and Dat contains the string.
 func (a *Session) ReceiveText(timeout int) (Reply, error) {
@@ -280,18 +835,96 @@ func (a *Session) RecordFile(file, format, escape string, timeout int, params ..
 	return a.sendMsg(fmt.Sprintf("RECORD FILE %s", cmd))
 }
 
+// RecordFileOptions holds the optional parameters of RecordFileWithOptions.
+type RecordFileOptions struct {
+	Offset         int //Offset in samples to seek to before recording, sent if greater than 0.
+	SilenceSeconds int //Seconds of silence that end the recording, sent as s=N if greater than 0.
+}
+
+// RecordFileWithOptions records to a given file like RecordFile, with the optional parameters
+// given in opts.
+func (a *Session) RecordFileWithOptions(file, format, escape string, timeout int, opts RecordFileOptions) (Reply, error) {
+	var params []interface{}
+	if opts.Offset > 0 {
+		params = append(params, opts.Offset)
+	}
+	if opts.SilenceSeconds > 0 {
+		params = append(params, fmt.Sprintf("s=%d", opts.SilenceSeconds))
+	}
+	return a.RecordFile(file, format, escape, timeout, params...)
+}
+
+// RecordFileDuration records to a given file like RecordFile, with a maximum record time of timeout.
+// A negative timeout is invalid and returns an error, use RecordFile with -1 for no timeout.
+func (a *Session) RecordFileDuration(file, format, escape string, timeout time.Duration, params ...interface{}) (Reply, error) {
+	if timeout < 0 {
+		return Reply{}, fmt.Errorf("invalid timeout: %v", timeout)
+	}
+	return a.RecordFile(file, format, escape, millis(timeout), params...)
+}
+
+// RecordFileResult records to a given file like RecordFile and returns the structured result
+// of the recording as parsed by ParseRecordResult.
+func (a *Session) RecordFileResult(file, format, escape string, timeout int, params ...interface{}) (RecordResult, error) {
+	r, err := a.RecordFile(file, format, escape, timeout, params...)
+	if err != nil {
+		return RecordResult{}, err
+	}
+	return ParseRecordResult(r)
+}
+
 // SayAlpha says a given character string. Res is 0 if playback completes without a digit
 // being pressed, the ASCII numerical value of the digit if one was pressed or -1 on error/hang-up.
 func (a *Session) SayAlpha(str, escape string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SAY ALPHA %q %q", str, escape))
 }
 
+// SayAlphaBytes says data like SayAlpha, hex-encoding any bytes that are not printable ASCII so that
+// only printable ASCII characters are said. Res is 0 if playback completes without a digit being pressed,
+// the ASCII numerical value of the digit if one was pressed or -1 on error/hang-up.
+func (a *Session) SayAlphaBytes(data []byte, escape string) (Reply, error) {
+	const hexDigits = "0123456789abcdef"
+	str := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b < ' ' || b > '~' {
+			str = append(str, hexDigits[b>>4], hexDigits[b&0x0f])
+			continue
+		}
+		str = append(str, b)
+	}
+	return a.SayAlpha(string(str), escape)
+}
+
+// SayAlphaFiltered says str like SayAlpha, dropping the characters for which filter returns false.
+// Res is 0 if playback completes without a digit being pressed, the ASCII numerical value of the digit
+// if one was pressed or -1 on error/hang-up.
+func (a *Session) SayAlphaFiltered(str, escape string, filter func(rune) bool) (Reply, error) {
+	str = strings.Map(func(c rune) rune {
+		if filter(c) {
+			return c
+		}
+		return -1
+	}, str)
+	return a.SayAlpha(str, escape)
+}
+
+// SayCharacter says a single character by its name. Res is 0 if playback completes without a digit
+// being pressed, the ASCII numerical value of the digit if one was pressed or -1 on error/hang-up.
+func (a *Session) SayCharacter(c rune, escape string) (Reply, error) {
+	return a.SayAlpha(string(c), escape)
+}
+
 // SayDate says a given date (Unix time format). Res is 0 if playback completes without a digit
 // being pressed, the ASCII numerical value of the digit if one was pressed or -1 on error/hang-up.
 func (a *Session) SayDate(date int64, escape string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SAY DATE \"%d\" %q", date, escape))
 }
 
+// SayDateValue says the date of t, see SayDate.
+func (a *Session) SayDateValue(t time.Time, escape string) (Reply, error) {
+	return a.SayDate(t.Unix(), escape)
+}
+
 // SayDateTime says a given time (Unix time format). Optional parameters:
 // format, the format the time should be said in. See voicemail.conf (defaults to ABdY 'digits/at' IMp).
 // timezone, acceptable values can be found in /usr/share/zoneinfo. Defaults to machine default.
@@ -305,6 +938,33 @@ func (a *Session) SayDateTime(time int64, escape string, params ...string) (Repl
 	return a.sendMsg(fmt.Sprintf("SAY DATETIME %s", cmd))
 }
 
+// SayDateTimeOptions holds the optional parameters of SayDateTimeWithOptions.
+type SayDateTimeOptions struct {
+	Format   string //The format the time should be said in, see voicemail.conf. Defaults to ABdY 'digits/at' IMp.
+	Timezone string //An IANA timezone name like Europe/Athens, passed through as is. Defaults to the asterisk machine's timezone.
+}
+
+// SayDateTimeWithOptions says a given time (Unix time format) like SayDateTime, with the optional
+// parameters given in opts. Either of the options can be set without the other.
+func (a *Session) SayDateTimeWithOptions(time int64, escape string, opts SayDateTimeOptions) (Reply, error) {
+	if opts.Timezone == "" {
+		if opts.Format == "" {
+			return a.SayDateTime(time, escape)
+		}
+		return a.SayDateTime(time, escape, opts.Format)
+	}
+	format := opts.Format
+	if format == "" {
+		format = "ABdY 'digits/at' IMp"
+	}
+	return a.SayDateTime(time, escape, format, opts.Timezone)
+}
+
+// SayDatetime says the date and time of t, see SayDateTime for the optional parameters.
+func (a *Session) SayDatetime(t time.Time, escape string, params ...string) (Reply, error) {
+	return a.SayDateTime(t.Unix(), escape, params...)
+}
+
 // SayDigits says a given digit. Res is 0 if playback completes without a digit being pressed,
 // the ASCII numerical value of the digit if one was pressed or -1 on error/hang-up.
 func (a *Session) SayDigits(digit int, escape string) (Reply, error) {
@@ -313,11 +973,20 @@ func (a *Session) SayDigits(digit int, escape string) (Reply, error) {
 
 // SayNumber says a given number. Optional parameter gender. Res is 0 if playback completes
 // without a digit being pressed, the ASCII numerical value of the digit if one was pressed or -1 on error/hang-up.
+//
+// Deprecated: int is 32-bit on 32-bit platforms, use SayNumberLarge for numbers outside the int32 range.
 func (a *Session) SayNumber(num int, escape string, gender ...string) (Reply, error) {
+	return a.SayNumberLarge(int64(num), escape, gender...)
+}
+
+// SayNumberLarge says a given int64 number like SayNumber. Optional parameter gender. Res is 0 if playback
+// completes without a digit being pressed, the ASCII numerical value of the digit if one was pressed or -1 on error/hang-up.
+func (a *Session) SayNumberLarge(num int64, escape string, gender ...string) (Reply, error) {
+	n := strconv.FormatInt(num, 10)
 	if gender != nil {
-		return a.sendMsg(fmt.Sprintf("SAY NUMBER \"%d\" %q %q", num, escape, gender[0]))
+		return a.sendMsg(fmt.Sprintf("SAY NUMBER %q %q %q", n, escape, gender[0]))
 	}
-	return a.sendMsg(fmt.Sprintf("SAY NUMBER \"%d\" %q", num, escape))
+	return a.sendMsg(fmt.Sprintf("SAY NUMBER %q %q", n, escape))
 }
 
 // SayPhonetic says a given character string with phonetics. Res is 0 if playback completes
@@ -332,6 +1001,11 @@ func (a *Session) SayTime(time int64, escape string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SAY TIME \"%d\" %q", time, escape))
 }
 
+// SayTimeValue says the time of t, see SayTime.
+func (a *Session) SayTimeValue(t time.Time, escape string) (Reply, error) {
+	return a.SayTime(t.Unix(), escape)
+}
+
 // SendImage sends images to channels supporting it. Res is 0 if image is sent, or if the channel
 // does not support image transmission. Result is -1 only on error/hang-up. Image names should not include extensions.
 func (a *Session) SendImage(image string) (Reply, error) {
@@ -344,27 +1018,82 @@ func (a *Session) SendText(text string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SEND TEXT %q", text))
 }
 
+// SendTextSafe sends text like SendText, truncated to at most maxLen bytes without splitting a
+// UTF-8 character. A maxLen of zero or less means no limit. An error is returned without sending
+// the command if text is not valid UTF-8 or contains non printable characters other than space.
+func (a *Session) SendTextSafe(text string, maxLen int) (Reply, error) {
+	if !utf8.ValidString(text) {
+		return Reply{}, fmt.Errorf("invalid UTF-8 text: %q", text)
+	}
+	for _, c := range text {
+		if !unicode.IsPrint(c) {
+			return Reply{}, fmt.Errorf("non printable character %U in text", c)
+		}
+	}
+	if maxLen > 0 && len(text) > maxLen {
+		n := maxLen
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = text[:n]
+	}
+	return a.SendText(text)
+}
+
 // SetAutohangup autohang-ups channel after a number of seconds. Setting time to 0 will cause the autohang-up
 // feature to be disabled on this channel. Res is always 0.
 func (a *Session) SetAutohangup(time int) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SET AUTOHANGUP \"%d\"", time))
 }
 
+// SetAutohangupDuration autohang-ups channel after d, rounded down to whole seconds.
+// A d shorter than one second, including zero or negative values, disables the autohang-up
+// feature. Res is always 0.
+func (a *Session) SetAutohangupDuration(d time.Duration) (Reply, error) {
+	if d <= 0 {
+		return a.SetAutohangup(0)
+	}
+	return a.SetAutohangup(int(d / time.Second))
+}
+
+// DisableAutohangup disables the autohang-up feature on this channel. Res is always 0.
+func (a *Session) DisableAutohangup() (Reply, error) {
+	return a.SetAutohangup(0)
+}
+
 // SetCallerid sets callerid for the current channel. Res is always 1.
 func (a *Session) SetCallerid(cid string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SET CALLERID %q", cid))
 }
 
+// SetCallerIDParsed sets the callerid name and number for the current channel, in the
+// "Name <number>" format. If name is empty only the number is set. Res is always 1.
+func (a *Session) SetCallerIDParsed(name, number string) (Reply, error) {
+	if name == "" {
+		return a.SetCallerid(number)
+	}
+	return a.SetCallerid(name + " <" + number + ">")
+}
+
 // SetContext sets channel context. Res is always 0.
 func (a *Session) SetContext(context string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SET CONTEXT %q", context))
 }
 
-// SetExtension changes channel extension. Res is always 0.
+// SetExtension changes channel extension. An error is returned without sending the command if ext
+// contains characters illegal in extension names, like newlines or semicolons. Res is always 0.
 func (a *Session) SetExtension(ext string) (Reply, error) {
+	if strings.ContainsAny(ext, "\r\n;") {
+		return Reply{}, fmt.Errorf("invalid extension: %q", ext)
+	}
 	return a.sendMsg(fmt.Sprintf("SET EXTENSION %q", ext))
 }
 
+// SetExtensionInt changes channel extension to a numeric one. Res is always 0.
+func (a *Session) SetExtensionInt(ext int) (Reply, error) {
+	return a.SetExtension(strconv.Itoa(ext))
+}
+
 // SetMusic enables/disables Music on hold generator by setting opt to "on" or "off".
 // Optional parameter: class, if not specified, then the default music on hold class will be used.
 // Res is always 0.
@@ -375,6 +1104,20 @@ func (a *Session) SetMusic(opt string, class ...string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SET MUSIC %q", opt))
 }
 
+// SetMusicOn enables the Music on hold generator like SetMusic. Optional parameter: class.
+// An error is returned without sending the command if class contains double quotes. Res is always 0.
+func (a *Session) SetMusicOn(class ...string) (Reply, error) {
+	if class != nil && strings.ContainsRune(class[0], '"') {
+		return Reply{}, fmt.Errorf("invalid music on hold class: %q", class[0])
+	}
+	return a.SetMusic("on", class...)
+}
+
+// SetMusicOff disables the Music on hold generator. Res is always 0.
+func (a *Session) SetMusicOff() (Reply, error) {
+	return a.SetMusic("off")
+}
+
 // SetPriority sets channel dialplan priority. The priority must be a valid priority or label.
 // Res is always 0.
 func (a *Session) SetPriority(priority string) (Reply, error) {
@@ -386,6 +1129,27 @@ func (a *Session) SetVariable(variable string, value interface{}) (Reply, error)
 	return a.sendMsg(fmt.Sprintf("SET VARIABLE %q \"%v\"", variable, value))
 }
 
+// SetVariableInt sets a channel variable to an integer value. Res is always 1.
+func (a *Session) SetVariableInt(variable string, value int64) (Reply, error) {
+	return a.SetVariable(variable, strconv.FormatInt(value, 10))
+}
+
+// SetVariableFloat sets a channel variable to a floating point value, formatted without an
+// exponent with prec digits after the decimal point. A prec of -1 uses the smallest number
+// of digits necessary to represent the value exactly. Res is always 1.
+func (a *Session) SetVariableFloat(variable string, value float64, prec int) (Reply, error) {
+	return a.SetVariable(variable, strconv.FormatFloat(value, 'f', prec, 64))
+}
+
+// SetVariableBool sets a channel variable to 1 for true or 0 for false, as expected by dialplan
+// conditional expressions. Res is always 1.
+func (a *Session) SetVariableBool(variable string, value bool) (Reply, error) {
+	if value {
+		return a.SetVariable(variable, "1")
+	}
+	return a.SetVariable(variable, "0")
+}
+
 // SpeechActivateGrammar activates a grammar. Res is 1 on success 0 on error.
 func (a *Session) SpeechActivateGrammar(grammar string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SPEECH ACTIVATE GRAMMAR %q", grammar))
@@ -411,6 +1175,30 @@ func (a *Session) SpeechLoadGrammar(grammar, path string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SPEECH LOAD GRAMMAR %q %q", grammar, path))
 }
 
+// SpeechLoadGrammarInline loads a grammar from its content instead of a file path. The content is
+// written to a temporary file that is passed to SpeechLoadGrammar and removed once the command
+// completes. The speech engine must read the grammar while loading it and Asterisk must share the
+// filesystem of the AGI application, so this isn't suitable for FastAGI servers on remote hosts.
+// Res is 1 on success 0 on error.
+func (a *Session) SpeechLoadGrammarInline(name, grammarContent string) (Reply, error) {
+	if grammarContent == "" {
+		return Reply{}, errors.New("empty grammar content")
+	}
+	f, err := os.CreateTemp("", "agi-grammar-")
+	if err != nil {
+		return Reply{}, err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(grammarContent); err != nil {
+		f.Close()
+		return Reply{}, err
+	}
+	if err = f.Close(); err != nil {
+		return Reply{}, err
+	}
+	return a.SpeechLoadGrammar(name, f.Name())
+}
+
 // SpeechRecognize recognizes speech. Res is 1 onsuccess, 0 in case of error
 // In case of success Dat contains a set of different inconsistent values.
 // Please refer to res_agi.c in asterisk source code for further info.
@@ -418,6 +1206,16 @@ func (a *Session) SpeechRecognize(prompt, timeout, offset string) (Reply, error)
 	return a.sendMsg(fmt.Sprintf("SPEECH RECOGNIZE %q %q %q", prompt, timeout, offset))
 }
 
+// SpeechRecognizeResult recognizes speech like SpeechRecognize and returns the structured
+// result as parsed by ParseSpeechResult.
+func (a *Session) SpeechRecognizeResult(prompt, timeout, offset string) (SpeechResult, error) {
+	r, err := a.SpeechRecognize(prompt, timeout, offset)
+	if err != nil {
+		return SpeechResult{}, err
+	}
+	return ParseSpeechResult(r)
+}
+
 // SpeechSet sets a speech engine setting. Res is 1 on success 0 on error.
 func (a *Session) SpeechSet(name, value string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("SPEECH SET %q %q", name, value))
@@ -452,6 +1250,27 @@ func (a *Session) TddMode(mode string) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("TDD MODE %q", mode))
 }
 
+// TddModeValue is a TDD mode accepted by SetTddMode.
+type TddModeValue string
+
+// TDD modes.
+const (
+	TddOn   TddModeValue = "on"
+	TddOff  TddModeValue = "off"
+	TddMate TddModeValue = "mate"
+	TddTdd  TddModeValue = "tdd"
+)
+
+// SetTddMode toggles TDD mode like TddMode. An error is returned without sending the command
+// if mode is not one of the TDD mode constants.
+func (a *Session) SetTddMode(mode TddModeValue) (Reply, error) {
+	switch mode {
+	case TddOn, TddOff, TddMate, TddTdd:
+		return a.TddMode(string(mode))
+	}
+	return Reply{}, fmt.Errorf("invalid TDD mode: %q", mode)
+}
+
 // Verbose logs a message to the asterisk verbose log.
 // Optional variable: level, the verbose level (1-4). Res is always 1.
 func (a *Session) Verbose(msg interface{}, level ...int) (Reply, error) {
@@ -461,9 +1280,32 @@ func (a *Session) Verbose(msg interface{}, level ...int) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("VERBOSE \"%v\"", msg))
 }
 
+// Verbosef logs a message formatted according to a format specifier to the asterisk verbose log.
+// Res is always 1.
+func (a *Session) Verbosef(format string, args ...interface{}) (Reply, error) {
+	return a.Verbose(fmt.Sprintf(format, args...))
+}
+
+// Verbosef2 logs a message formatted according to a format specifier to the asterisk verbose log
+// at the given verbose level (1-4). Res is always 1.
+func (a *Session) Verbosef2(level int, format string, args ...interface{}) (Reply, error) {
+	return a.Verbose(fmt.Sprintf(format, args...), level)
+}
+
 // WaitForDigit waits for a digit to be pressed. Use -1 for the timeout value if you desire
 // the call to block indefinitely. Res is -1 on channel failure, 0 if no digit is received
 // in the timeout, or the ASCII numerical value of the digit if one is received.
 func (a *Session) WaitForDigit(timeout int) (Reply, error) {
 	return a.sendMsg(fmt.Sprintf("WAIT FOR DIGIT %d", timeout))
 }
+
+// WaitForDigitDuration waits up to d for a digit to be pressed, see WaitForDigit.
+// A negative d blocks indefinitely.
+func (a *Session) WaitForDigitDuration(d time.Duration) (Reply, error) {
+	return a.WaitForDigit(millis(d))
+}
+
+// WaitForDigitBlock waits indefinitely for a digit to be pressed, see WaitForDigit.
+func (a *Session) WaitForDigitBlock() (Reply, error) {
+	return a.WaitForDigit(-1)
+}
@@ -8,8 +8,20 @@ package agi
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode"
 )
 
 // AGI environment data
@@ -71,6 +83,13 @@ var repInv = []byte(
 some random reply that we are not supposed to get
 `)
 
+var repMulti = []byte(
+	"200-result=1\r\nextra: data\r\nmore: data\r\n\r\n" +
+		"200-result=0 (timeout)\nextra: data\n\n" +
+		"200 result=1\n" +
+		"200 result=1 (C:\\)\\\n" +
+		"200 result=0\n")
+
 var repVal = []byte(
 	`200 result=1
 200 result=1
@@ -105,6 +124,27 @@ func TestParseEnv(t *testing.T) {
 	if a.Env["arg_3"] != "3" {
 		t.Errorf("Error parsing arg3. Expecting: 3, got: %s", a.Env["arg_3"])
 	}
+	if a.Channel() != "SIP/1234-00000000" || a.UniqueID() != "1397044468.0" || a.Context() != "default" {
+		t.Errorf("Error accessing AGI environment: %s %s %s", a.Channel(), a.UniqueID(), a.Context())
+	}
+	if args := a.Args(); len(args) != 3 || args[1] != "argument 2" {
+		t.Errorf("Error accessing AGI arguments. Expecting 3 arguments, got: %q", args)
+	}
+	if a.Arg(3) != "3" || a.Arg(0) != "" || a.Arg(4) != "" {
+		t.Errorf("Error accessing AGI argument 3. Expecting: 3, got: %s", a.Arg(3))
+	}
+	penv, err := a.ParsedEnv()
+	if err != nil {
+		t.Fatalf("Failed to parse AGI environment: %v", err)
+	}
+	if !penv.Network || penv.NetworkScript != "foo?" || penv.CallingPres != 67 || penv.Priority != 1 ||
+		penv.Enhanced || penv.ThreadID != -1289290944 || len(penv.Args) != 3 {
+		t.Errorf("Error parsing AGI environment: %+v", penv)
+	}
+	a.Env["priority"] = "n"
+	if _, err = a.ParsedEnv(); err == nil {
+		t.Error("ParsedEnv failed to detect invalid agi_priority")
+	}
 	// invalid environment data
 	b := New()
 	b.buf = bufio.NewReadWriter(
@@ -147,23 +187,23 @@ func TestParseRespomse(t *testing.T) {
 		t.Errorf("Error parsing AGI complex 200 response. Expecting: (speech) endpos=1234 results=foo bar, got: %s", r.Dat)
 	}
 	_, err = a.parseResponse()
-	if err == nil {
+	if !errors.Is(err, Err510Response) {
 		t.Error("No error after parsing AGI 510 response.")
 	}
 	_, err = a.parseResponse()
-	if err == nil {
+	if !errors.Is(err, Err511Response) {
 		t.Error("No error after parsing AGI 511 response.")
 	}
 	_, err = a.parseResponse()
-	if err == nil {
+	if !errors.Is(err, Err520Response) {
 		t.Error("No error after parsing AGI 520 response.")
 	}
 	_, err = a.parseResponse()
-	if err == nil {
+	if !errors.Is(err, Err520Response) {
 		t.Error("No error after parsing AGI 520 response containing usage details.")
 	}
 	_, err = a.parseResponse()
-	if err == nil || err.Error() != "HANGUP" {
+	if err == nil || err.Error() != "HANGUP" || !errors.Is(err, ErrHangupResponse) {
 		t.Error("Failed to detect a HANGUP reguest.")
 	}
 	// Invalid responses
@@ -173,15 +213,15 @@ func TestParseRespomse(t *testing.T) {
 		bufio.NewWriter(ioutil.Discard),
 	)
 	_, err = b.parseResponse()
-	if err == nil {
+	if !errors.Is(err, ErrMalformedAGIResponse{}) {
 		t.Error("No error after parsing a partial AGI response.")
 	}
 	_, err = b.parseResponse()
-	if err == nil {
+	if !errors.Is(err, ErrMalformed200Response{}) {
 		t.Error("No error after parsing a malformed AGI response.")
 	}
 	_, err = b.parseResponse()
-	if err == nil {
+	if !errors.Is(err, ErrMalformed200Response{}) {
 		t.Error("No error after parsing a malformed AGI response.")
 	}
 	_, err = b.parseResponse()
@@ -198,6 +238,612 @@ func TestParseRespomse(t *testing.T) {
 	}
 }
 
+// fakeAsterisk plays the asterisk side of an AGI session. It serves the AGI environment
+// and then releases one reply line for every command line written to it.
+type fakeAsterisk struct {
+	in      bytes.Buffer
+	out     bytes.Buffer
+	replies [][]byte
+}
+
+func newFakeAsterisk(replies ...string) *fakeAsterisk {
+	f := new(fakeAsterisk)
+	f.in.Write(env)
+	for _, r := range replies {
+		f.replies = append(f.replies, []byte(r+"\n"))
+	}
+	return f
+}
+
+func (f *fakeAsterisk) Read(p []byte) (int, error) {
+	return f.in.Read(p)
+}
+
+func (f *fakeAsterisk) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\n' && len(f.replies) > 0 {
+			f.in.Write(f.replies[0])
+			f.replies = f.replies[1:]
+		}
+	}
+	return f.out.Write(p)
+}
+
+func (f *fakeAsterisk) rw() *bufio.ReadWriter {
+	return bufio.NewReadWriter(bufio.NewReader(f), bufio.NewWriter(f))
+}
+
+// Test parsing of multi-line AGI 200 responses
+func TestParseResponseMulti(t *testing.T) {
+	a := New()
+	a.buf = bufio.NewReadWriter(
+		bufio.NewReader(bytes.NewReader(repMulti)),
+		bufio.NewWriter(ioutil.Discard),
+	)
+	tests := []Reply{
+		{1, "extra: data\nmore: data"},
+		{0, "(timeout)\nextra: data"},
+		{1, ""},
+		// A trailing backslash is part of the data, not a continuation marker.
+		{1, "(C:\\)\\"},
+		{0, ""},
+	}
+	for _, want := range tests {
+		r, err := a.parseResponse()
+		if err != nil {
+			t.Fatalf("Error parsing multi-line AGI 200 response: %v", err)
+		}
+		if r != want {
+			t.Errorf("Error parsing multi-line AGI 200 response. Expecting: %+v, got: %+v", want, r)
+		}
+	}
+}
+
+// Test unwrapping of AGI 200 result parsing errors
+func TestParseResponseError(t *testing.T) {
+	a := New()
+	a.buf = bufio.NewReadWriter(
+		bufio.NewReader(bytes.NewReader([]byte("200 result=foo\n"))),
+		bufio.NewWriter(ioutil.Discard),
+	)
+	_, err := a.parseResponse()
+	var perr ErrFailedToParse200Response
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expecting ErrFailedToParse200Response, got: %v", err)
+	}
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) {
+		t.Errorf("Failed to unwrap the parsing error: %v", perr.Err)
+	}
+}
+
+// Test extraction of AGI command names
+func TestCommandName(t *testing.T) {
+	tests := map[string]string{
+		"ANSWER":                            "ANSWER",
+		"STREAM FILE \"echo-test\" \"*#\"":  "STREAM FILE",
+		"WAIT FOR DIGIT 5000":               "WAIT FOR DIGIT",
+		"EXEC Playback \"hello\"":           "EXEC",
+		"GET FULL VARIABLE \"${CALLERID}\"": "GET FULL VARIABLE",
+	}
+	for cmd, name := range tests {
+		if n := commandName(cmd); n != name {
+			t.Errorf("Error getting command name of %s. Expecting: %s, got: %s", cmd, name, n)
+		}
+	}
+}
+
+// Test session initialization with unbuffered I/O
+func TestInitRW(t *testing.T) {
+	c, ast := net.Pipe()
+	defer c.Close()
+	cmds := make(chan string, 1)
+	go func() {
+		defer ast.Close()
+		ast.Write(env)
+		cmd, err := bufio.NewReader(ast).ReadString(10)
+		if err != nil {
+			close(cmds)
+			return
+		}
+		cmds <- cmd
+		ast.Write([]byte("200 result=1 (foo)\n"))
+	}()
+	a := New()
+	if err := a.InitRW(c, c); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if len(a.Env) != 25 || a.Env["channel"] != "SIP/1234-00000000" {
+		t.Errorf("Unexpected AGI environment: %v", a.Env)
+	}
+	r, err := a.GetVariable("foo")
+	if err != nil || r.Res != 1 || r.Dat != "foo" {
+		t.Errorf("Unexpected reply: %+v %v", r, err)
+	}
+	if cmd := <-cmds; cmd != "GET VARIABLE \"foo\"\n" {
+		t.Errorf("Unexpected command: %q", cmd)
+	}
+	// Asterisk closed the connection, the next command fails with the I/O error.
+	if _, err = a.Answer(); err == nil || isProtocolError(err) {
+		t.Errorf("Expecting I/O error, got: %v", err)
+	}
+}
+
+// Test command cancellation through the session context
+func TestInitContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := newFakeAsterisk("200 result=1", "200 result=1")
+	a := New()
+	err := a.InitContext(ctx, f.rw())
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	r, err := a.Answer()
+	if err != nil || r.Res != 1 {
+		t.Errorf("Failed to send AGI command with active context: %v", err)
+	}
+	f.out.Reset()
+	cancel()
+	_, err = a.Answer()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expecting context.Canceled error, got: %v", err)
+	}
+	if f.out.Len() != 0 {
+		t.Errorf("Command sent after context cancellation: %s", f.out.String())
+	}
+}
+
+// Test cancellation of a command waiting for a reply
+func TestInitContextBlocked(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(env)
+	ctx, cancel := context.WithCancel(context.Background())
+	a := New()
+	err := a.InitContext(ctx, bufio.NewReadWriter(bufio.NewReader(pr), bufio.NewWriter(ioutil.Discard)))
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	time.AfterFunc(20*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Answer()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expecting context.Canceled error, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Command still blocked after context cancellation")
+	}
+}
+
+// Test dead channel detection
+func TestDeadChannel(t *testing.T) {
+	f := newFakeAsterisk("511 Command Not Permitted on a dead channel")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	_, err := a.Answer()
+	var derr DeadChannelError
+	if !errors.Is(err, Err511Response) || !errors.As(err, &derr) || derr.Channel != "SIP/1234-00000000" {
+		t.Fatalf("Expecting dead channel error, got: %v", err)
+	}
+	if !a.IsDead() {
+		t.Error("Channel not marked as dead after a 511 response")
+	}
+	f.out.Reset()
+	if _, err = a.Answer(); !errors.Is(err, Err511Response) || f.out.Len() != 0 {
+		t.Errorf("Command sent on a dead channel: %q %v", f.out.String(), err)
+	}
+}
+
+// Test IsDead while a command is in progress
+func TestIsDeadConcurrent(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(env)
+	a := New()
+	err := a.Init(bufio.NewReadWriter(bufio.NewReader(pr), bufio.NewWriter(ioutil.Discard)))
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	go pw.Write([]byte("511 Command Not Permitted on a dead channel\n"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for !a.IsDead() {
+			time.Sleep(time.Microsecond)
+		}
+	}()
+	a.Answer()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Channel not marked as dead after a 511 response")
+	}
+}
+
+// Test per-command timeouts
+func TestSetCommandTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		pw.Write(env)
+		pw.Write([]byte("200 result=1\n"))
+	}()
+	a := New()
+	err := a.Init(bufio.NewReadWriter(bufio.NewReader(pr), bufio.NewWriter(ioutil.Discard)))
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.SetCommandTimeout(20 * time.Millisecond)
+	if _, err = a.Answer(); err != nil {
+		t.Errorf("Failed to send AGI command: %v", err)
+	}
+	_, err = a.Answer()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expecting deadline exceeded error, got: %v", err)
+	}
+}
+
+// Test command history recording
+func TestCommandHistory(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=1", "510 Invalid or unknown command")
+	a := New(WithHistoryCapacity(2))
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if h := a.CommandHistory(0); len(h) != 0 {
+		t.Errorf("Expecting empty history, got: %v", h)
+	}
+	a.Answer()
+	a.Noop()
+	a.RawCommand("FOO")
+	h := a.CommandHistory(0)
+	if len(h) != 2 || h[0].Cmd != "NOOP " || h[0].Reply.Res != 1 || h[1].Cmd != " FOO" ||
+		!errors.Is(h[1].Err, Err510Response) || h[1].At.Before(h[0].At) {
+		t.Errorf("Unexpected command history: %+v", h)
+	}
+	if h = a.CommandHistory(1); len(h) != 1 || h[0].Cmd != " FOO" {
+		t.Errorf("Unexpected command history: %+v", h)
+	}
+	if h = New().CommandHistory(1); h != nil {
+		t.Errorf("Expecting no history when disabled, got: %+v", h)
+	}
+}
+
+// Test session destruction
+func TestDestroy(t *testing.T) {
+	f := newFakeAsterisk("200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	hup := a.HangupChan()
+	a.Destroy()
+	a.Destroy()
+	select {
+	case <-hup:
+	case <-time.After(time.Second):
+		t.Error("HangupChan not closed by Destroy")
+	}
+	if len(a.Env) != 0 {
+		t.Errorf("Env not cleared: %v", a.Env)
+	}
+	if _, err := a.Answer(); err == nil {
+		t.Error("Expecting commands to fail after Destroy")
+	}
+}
+
+// Test session event hooks
+func TestSetHooks(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "HANGUP")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	var events []string
+	hangup := make(chan struct{})
+	a.SetHooks(Hooks{
+		OnCommand:  func(cmd string) { events = append(events, "command "+cmd) },
+		OnResponse: func(r Reply, err error) { events = append(events, fmt.Sprintf("response %d %v", r.Res, err)) },
+		OnHangup:   func() { close(hangup) },
+	})
+	a.Answer()
+	a.Answer()
+	want := []string{"command ANSWER", "response 0 <nil>", "command ANSWER", "response 0 HANGUP"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Expecting events: %q, got: %q", want, events)
+	}
+	select {
+	case <-hangup:
+	case <-time.After(time.Second):
+		t.Error("OnHangup not called")
+	}
+}
+
+// Test event hooks calling back into the session
+func TestSetHooksReentrant(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "HANGUP")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	var counts []int
+	hangup := make(chan int, 1)
+	a.SetHooks(Hooks{
+		OnCommand:  func(cmd string) { counts = append(counts, a.CommandCount()) },
+		OnResponse: func(r Reply, err error) { counts = append(counts, a.CommandCount()) },
+		OnHangup:   func() { hangup <- a.CommandCount() },
+	})
+	done := make(chan struct{})
+	go func() {
+		a.Answer()
+		a.Answer()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Session deadlocked by hooks calling back into it")
+	}
+	if want := []int{0, 1, 1, 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("Expecting command counts: %v, got: %v", want, counts)
+	}
+	select {
+	case n := <-hangup:
+		if n != 2 {
+			t.Errorf("Expecting command count 2 on hangup, got: %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnHangup not called")
+	}
+}
+
+// Test keepalive pings with a timeout
+func TestPing(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		pw.Write(env)
+		pw.Write([]byte("200 result=0\n"))
+	}()
+	a := New()
+	err := a.Init(bufio.NewReadWriter(bufio.NewReader(pr), bufio.NewWriter(ioutil.Discard)))
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if err = a.Ping(time.Second); err != nil {
+		t.Errorf("Failed to ping session: %v", err)
+	}
+	if err = a.Ping(20 * time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expecting deadline exceeded error, got: %v", err)
+	}
+	if a.cmdTimeout != 0 {
+		t.Errorf("Command timeout changed by Ping: %v", a.cmdTimeout)
+	}
+}
+
+// Test pipelined AGI commands
+func TestPipeline(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=1", "200 result=0 endpos=1234")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	p := a.Pipeline()
+	p.Answer()
+	p.SetVariable("foo", "bar")
+	p.StreamFile("echo-test", "*#")
+	if f.out.Len() != 0 {
+		t.Fatalf("Pipelined commands sent before Execute: %s", f.out.String())
+	}
+	replies, errs := p.Execute()
+	if len(replies) != 3 || len(errs) != 3 {
+		t.Fatalf("Expecting 3 replies, got: %d", len(replies))
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Error executing pipelined command %d: %v", i, err)
+		}
+	}
+	if replies[1].Res != 1 || replies[2].Dat != "endpos=1234" {
+		t.Errorf("Unexpected pipelined replies: %v", replies)
+	}
+	cmds := "ANSWER\nSET VARIABLE \"foo\" \"bar\"\nSTREAM FILE \"echo-test\" \"*#\"\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
+
+// Test session bookkeeping of pipelined commands
+func TestPipelineBookkeeping(t *testing.T) {
+	p := New().Pipeline()
+	p.Answer()
+	if _, errs := p.Execute(); errs[0] == nil || errs[0].Error() != "session not initialized" {
+		t.Errorf("Expecting session not initialized error, got: %v", errs[0])
+	}
+	f := newFakeAsterisk("200 result=0", "510 Invalid or unknown command")
+	a := New(WithHistoryCapacity(5))
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	var cmds []string
+	a.SetHooks(Hooks{OnCommand: func(cmd string) { cmds = append(cmds, cmd) }})
+	p = a.Pipeline()
+	p.Answer()
+	p.Verbose("test", 1)
+	if _, errs := p.Execute(); errs[0] != nil || !errors.Is(errs[1], Err510Response) {
+		t.Errorf("Unexpected pipelined command errors: %v", errs)
+	}
+	if a.CommandCount() != 2 || len(cmds) != 2 {
+		t.Errorf("Expecting 2 counted and hooked commands, got: %d %v", a.CommandCount(), cmds)
+	}
+	if h := a.CommandHistory(5); len(h) != 2 || h[1].Cmd != "VERBOSE \"test\" 1" || !errors.Is(h[1].Err, Err510Response) {
+		t.Errorf("Unexpected command history: %+v", h)
+	}
+}
+
+// Test asynchronous hangup notification
+func TestHangupChan(t *testing.T) {
+	f := newFakeAsterisk("200 result=1\nHANGUP")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	hangup := a.HangupChan()
+	if _, err := a.Answer(); err != nil {
+		t.Fatalf("Failed to send AGI command: %v", err)
+	}
+	select {
+	case <-hangup:
+	case <-time.After(time.Second):
+		t.Fatal("Failed to detect a buffered HANGUP request")
+	}
+	_, err := a.Answer()
+	var herr HangupError
+	if !errors.Is(err, ErrHangupResponse) || !errors.As(err, &herr) {
+		t.Fatalf("Expecting HANGUP error, got: %v", err)
+	}
+	if herr.SessionID != "1397044468.0" || herr.Channel != "SIP/1234-00000000" {
+		t.Errorf("Unexpected hangup error details: %+v", herr)
+	}
+}
+
+// Test asynchronous notification of a HANGUP request received while idle
+func TestHangupChanIdle(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		pw.Write(env)
+		pw.Write([]byte("200 result=1\n"))
+		time.Sleep(3 * hangupPollInterval)
+		pw.Write([]byte("HANGUP\n"))
+	}()
+	a := New()
+	err := a.Init(bufio.NewReadWriter(bufio.NewReader(pr), bufio.NewWriter(ioutil.Discard)))
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	hangup := a.HangupChan()
+	if _, err := a.Answer(); err != nil {
+		t.Fatalf("Failed to send AGI command: %v", err)
+	}
+	select {
+	case <-hangup:
+		t.Fatal("HANGUP detected before it was sent")
+	case <-time.After(hangupPollInterval):
+	}
+	select {
+	case <-hangup:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Failed to detect a HANGUP request received while idle")
+	}
+	if _, err := a.Answer(); !errors.Is(err, ErrHangupResponse) {
+		t.Errorf("Expecting HANGUP error, got: %v", err)
+	}
+}
+
+// testLogger records debug messages and their arguments.
+type testLogger struct {
+	debug [][]interface{}
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) {
+	l.debug = append(l.debug, append([]interface{}{msg}, args...))
+}
+func (l *testLogger) Info(msg string, args ...interface{})  {}
+func (l *testLogger) Error(msg string, args ...interface{}) {}
+
+// Test command-level tracing
+func TestSetLogger(t *testing.T) {
+	f := newFakeAsterisk("200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	l := new(testLogger)
+	a.SetLogger(l)
+	a.Answer()
+	if len(l.debug) != 2 {
+		t.Fatalf("Expecting 2 debug log entries, got: %d", len(l.debug))
+	}
+	cmd := fmt.Sprint(l.debug[0]...)
+	if cmd != fmt.Sprint("agi command", "session_id", "1397044468.0", "command", "ANSWER") {
+		t.Errorf("Unexpected command log entry: %v", l.debug[0])
+	}
+	rep := fmt.Sprint(l.debug[1]...)
+	if rep != fmt.Sprint("agi reply", "session_id", "1397044468.0", "reply", "200 result=1") {
+		t.Errorf("Unexpected reply log entry: %v", l.debug[1])
+	}
+}
+
+// Test session deadlines on I/O without native deadline support
+func TestSetDeadline(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(env)
+	a := New()
+	err := a.Init(bufio.NewReadWriter(bufio.NewReader(pr), bufio.NewWriter(ioutil.Discard)))
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = a.Answer()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expecting deadline exceeded error, got: %v", err)
+	}
+}
+
+// Test session reuse through SessionPool
+func TestSessionPool(t *testing.T) {
+	var pool SessionPool
+	a := pool.Get()
+	err := a.Init(bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(env)), nil))
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	pool.Put(a)
+	if len(a.Env) != 0 || a.buf != nil {
+		t.Errorf("Session returned to the pool was not reset: %v", a.Env)
+	}
+	b := pool.Get()
+	if b.Env == nil {
+		t.Fatal("Pooled session has nil Env")
+	}
+	err = b.Init(bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(env)), nil))
+	if err != nil || len(b.Env) != 25 {
+		t.Errorf("Failed to initialize pooled AGI session: %v", err)
+	}
+}
+
+// Test that session settings survive Reset but not SessionPool.Put
+func TestSessionReset(t *testing.T) {
+	a := New().WithRetry(2, time.Second)
+	a.SetCommandTimeout(time.Second)
+	a.EnvMax = 30
+	err := a.Init(bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(env)), nil))
+	if err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	err = a.Reset(bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(env)), nil))
+	if err != nil {
+		t.Fatalf("Failed to reset AGI session: %v", err)
+	}
+	if a.retries != 2 || a.retryBackoff != time.Second || a.cmdTimeout != time.Second || a.EnvMax != 30 {
+		t.Errorf("Session settings lost after Reset: %d %v %v %d", a.retries, a.retryBackoff, a.cmdTimeout, a.EnvMax)
+	}
+	var pool SessionPool
+	pool.Put(a)
+	if a.retries != 0 || a.retryBackoff != 0 || a.cmdTimeout != 0 || a.EnvMax != 0 {
+		t.Errorf("Session settings kept after Put: %d %v %v %d", a.retries, a.retryBackoff, a.cmdTimeout, a.EnvMax)
+	}
+}
+
 // // Test the generation of AGI commands
 // func TestCmd(t *testing.T) {
 // 	var r Reply
@@ -290,3 +936,716 @@ func BenchmarkParseRes(b *testing.B) {
 // 		a.Hangup()
 // 	}
 // }
+
+// Test protocol tracing
+func TestTrace(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	var trace bytes.Buffer
+	a.Trace(&trace)
+	if _, err := a.Answer(); err != nil {
+		t.Fatalf("Answer failed: %v", err)
+	}
+	if trace.String() != "ANSWER\n200 result=0\n" {
+		t.Errorf("Unexpected trace: %q", trace.String())
+	}
+	a.Trace(nil)
+	if _, err := a.Answer(); err != nil {
+		t.Fatalf("Answer failed: %v", err)
+	}
+	if a.CommandCount() != 2 || a.ElapsedTime() <= 0 {
+		t.Errorf("Unexpected session stats: %d commands in %v", a.CommandCount(), a.ElapsedTime())
+	}
+	if trace.Len() != len("ANSWER\n200 result=0\n") {
+		t.Errorf("Trace output after Trace(nil): %q", trace.String())
+	}
+}
+
+// Test Session configuration through New options
+func TestNewOptions(t *testing.T) {
+	var trace bytes.Buffer
+	hangup := make(chan struct{})
+	f := newFakeAsterisk("HANGUP")
+	a := New(
+		WithTraceWriter(&trace),
+		WithCommandTimeout(time.Second),
+		WithHangupCallback(func() { close(hangup) }),
+	)
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if !bytes.HasPrefix(trace.Bytes(), env) {
+		t.Errorf("AGI environment missing from trace: %q", trace.String())
+	}
+	if a.cmdTimeout != time.Second {
+		t.Errorf("Unexpected command timeout: %v", a.cmdTimeout)
+	}
+	if _, err := a.Answer(); !IsHangup(err) {
+		t.Fatalf("Expecting hangup error, got: %v", err)
+	}
+	select {
+	case <-hangup:
+	case <-time.After(time.Second):
+		t.Error("Hangup callback was not called")
+	}
+}
+
+// Test formatting of typed channel variables
+func TestSetVariableTyped(t *testing.T) {
+	f := newFakeAsterisk("200 result=1", "200 result=1", "200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.SetVariableInt("INT", -42)
+	a.SetVariableFloat("FLOAT", 1e21, -1)
+	a.SetVariableBool("BOOL", true)
+	want := "SET VARIABLE \"INT\" \"-42\"\n" +
+		"SET VARIABLE \"FLOAT\" \"1000000000000000000000\"\n" +
+		"SET VARIABLE \"BOOL\" \"1\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test parsing of typed channel variables
+func TestGetVariableTyped(t *testing.T) {
+	f := newFakeAsterisk("200 result=1 (42)", "200 result=1 (true)", "200 result=0", "200 result=1 (foo)")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if n, err := a.GetVariableInt("INT"); err != nil || n != 42 {
+		t.Errorf("Error getting integer variable: %d %v", n, err)
+	}
+	if b, err := a.GetVariableBool("BOOL"); err != nil || !b {
+		t.Errorf("Error getting boolean variable: %v %v", b, err)
+	}
+	if _, err := a.GetVariableInt("UNSET"); !errors.Is(err, ErrVariableNotSet{}) {
+		t.Errorf("Expecting ErrVariableNotSet, got: %v", err)
+	}
+	var numErr *strconv.NumError
+	if _, err := a.GetVariableInt("FOO"); !errors.As(err, &numErr) {
+		t.Errorf("Expecting parsing error, got: %v", err)
+	}
+}
+
+// Test JSON session records
+func TestSessionJSON(t *testing.T) {
+	f := newFakeAsterisk("200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.Answer()
+	data, err := json.Marshal(a.MarshalLog())
+	if err != nil {
+		t.Fatalf("Failed to encode session record: %v", err)
+	}
+	b, err := LoadEnvFromJSON(data)
+	if err != nil {
+		t.Fatalf("Failed to load session record: %v", err)
+	}
+	if len(b.Env) != len(a.Env) || b.Channel() != a.Channel() {
+		t.Errorf("Session environment was not restored: %v", b.Env)
+	}
+	b, err = LoadEnvFromJSON([]byte(`{"agi_channel": "SIP/1234-00000000", "uniqueid": "1397044468.0"}`))
+	if err != nil || b.Channel() != "SIP/1234-00000000" || b.UniqueID() != "1397044468.0" {
+		t.Errorf("Failed to load environment dump: %v %v", b, err)
+	}
+	if _, err = b.Answer(); err == nil {
+		t.Error("AGI command succeeded on a session that is not initialized")
+	}
+}
+
+// Test channel liveness probing
+func TestIsAlive(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "HANGUP")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if alive, err := a.IsAlive(); !alive || err != nil {
+		t.Errorf("Expecting channel to be alive, got: %v %v", alive, err)
+	}
+	if alive, err := a.IsAlive(); alive || err != nil {
+		t.Errorf("Expecting channel to be hung up, got: %v %v", alive, err)
+	}
+	if alive, _ := a.IsAlive(); alive || f.out.String() != "NOOP \nNOOP \n" {
+		t.Errorf("Unexpected probing after hangup: %q", f.out.String())
+	}
+}
+
+// Test the optional parameters of ControlStreamFileWithOptions
+func TestControlStreamFileWithOptions(t *testing.T) {
+	f := newFakeAsterisk("200 result=0 endpos=1234", "200 result=0 endpos=1234", "200 result=0 endpos=1234")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.ControlStreamFileWithOptions("foo", "#", ControlStreamOptions{})
+	a.ControlStreamFileWithOptions("foo", "#", ControlStreamOptions{SkipMS: 5000, FFChar: "6"})
+	r, _ := a.ControlStreamFileWithOptions("foo", "#", ControlStreamOptions{PauseChar: "5"})
+	want := "CONTROL STREAM FILE \"foo\" \"#\"\n" +
+		"CONTROL STREAM FILE \"foo\" \"#\" \"5000\" \"6\"\n" +
+		"CONTROL STREAM FILE \"foo\" \"#\" \"3000\" \"*\" \"#\" \"5\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+	if r.Dat != "1234" {
+		t.Errorf("Unexpected reply data: %s", r.Dat)
+	}
+}
+
+// Test endpos stripping of ControlStreamFile replies
+func TestControlStreamFileEndPos(t *testing.T) {
+	f := newFakeAsterisk("200 result=0 endpos=1234", "200 result=54 endpos=500", "200 result=-1 endpos=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	tests := []struct {
+		params []interface{}
+		res    int
+		pos    int
+	}{
+		{nil, 0, 1234},
+		{[]interface{}{3000, "6", "4"}, '6', 500},
+		{[]interface{}{3000}, -1, 0},
+	}
+	for _, test := range tests {
+		r, err := a.ControlStreamFile("foo", "#", test.params...)
+		if err != nil {
+			t.Fatalf("Failed to send CONTROL STREAM FILE command: %v", err)
+		}
+		if pos, err := r.EndPos(); err != nil || r.Res != test.res || pos != test.pos {
+			t.Errorf("Unexpected reply: %+v, expecting Res: %d EndPos: %d, got: %d %v", r, test.res, test.pos, pos, err)
+		}
+	}
+	want := "CONTROL STREAM FILE \"foo\" \"#\"\n" +
+		"CONTROL STREAM FILE \"foo\" \"#\" \"3000\" \"6\" \"4\"\n" +
+		"CONTROL STREAM FILE \"foo\" \"#\" \"3000\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+	if _, err := (Reply{Dat: "(timeout)"}).EndPos(); err == nil {
+		t.Error("Expecting EndPos to fail for non numeric data")
+	}
+}
+
+// Test the optional parameters of RecordFileWithOptions
+func TestRecordFileWithOptions(t *testing.T) {
+	f := newFakeAsterisk("200 result=0 (timeout) endpos=8000", "200 result=0 (timeout) endpos=8000")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.RecordFileWithOptions("foo", "wav", "#", 5000, RecordFileOptions{SilenceSeconds: 3})
+	a.RecordFileWithOptions("foo", "wav", "#", 5000, RecordFileOptions{Offset: 800, SilenceSeconds: 3})
+	want := "RECORD FILE \"foo\" \"wav\" \"#\" 5000 \"s=3\"\n" +
+		"RECORD FILE \"foo\" \"wav\" \"#\" 5000 \"800\" \"s=3\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test the optional parameters of SayDateTimeWithOptions
+func TestSayDateTimeWithOptions(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.SayDateTimeWithOptions(1397044468, "", SayDateTimeOptions{Timezone: "Europe/Athens"})
+	a.SayDateTimeWithOptions(1397044468, "", SayDateTimeOptions{Format: "IMp"})
+	want := "SAY DATETIME \"1397044468\" \"\" \"ABdY 'digits/at' IMp\" \"Europe/Athens\"\n" +
+		"SAY DATETIME \"1397044468\" \"\" \"IMp\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test callerid parsing and setting
+func TestCallerID(t *testing.T) {
+	tests := []struct {
+		cid, name, number string
+	}{
+		{"John Doe <1234>", "John Doe", "1234"},
+		{"\"Doe, John\" <+301234>", "Doe, John", "+301234"},
+		{"<1234>", "", "1234"},
+		{"1234", "", "1234"},
+		{"John", "John", ""},
+		{"", "", ""},
+	}
+	for _, tc := range tests {
+		name, number := ParseCallerID(tc.cid)
+		if name != tc.name || number != tc.number {
+			t.Errorf("Error parsing %q. Expecting: %q %q, got: %q %q", tc.cid, tc.name, tc.number, name, number)
+		}
+	}
+	f := newFakeAsterisk("200 result=1", "200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.SetCallerIDParsed("John Doe", "1234")
+	a.SetCallerIDParsed("", "1234")
+	want := "SET CALLERID \"John Doe <1234>\"\nSET CALLERID \"1234\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test retrying of commands failing with 520 responses
+func TestWithRetry(t *testing.T) {
+	f := newFakeAsterisk("520 Invalid command syntax.", "200 result=1", "520 Invalid command syntax.",
+		"520 Invalid command syntax.", "510 Invalid or unknown command")
+	a := New().WithRetry(1, 5*time.Millisecond)
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if r, err := a.Answer(); err != nil || r.Res != 1 {
+		t.Errorf("Expecting successful retry, got: %v %v", r, err)
+	}
+	if _, err := a.Answer(); !errors.Is(err, Err520Response) {
+		t.Errorf("Expecting Err520Response after exhausting retries, got: %v", err)
+	}
+	if _, err := a.Answer(); !errors.Is(err, Err510Response) {
+		t.Errorf("Expecting Err510Response without retries, got: %v", err)
+	}
+	if n := strings.Count(f.out.String(), "ANSWER\n"); n != 5 {
+		t.Errorf("Expecting 5 commands sent, got: %d", n)
+	}
+}
+
+// Test rejection of commands with control characters
+func TestInvalidCommand(t *testing.T) {
+	f := newFakeAsterisk("200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	_, err := a.Verbose("foo\x00bar")
+	var ierr ErrInvalidCommand
+	if !errors.As(err, &ierr) || ierr.Pos != 12 || ierr.Byte != 0 {
+		t.Errorf("Expecting ErrInvalidCommand at position 12, got: %v", err)
+	}
+	if _, err = a.Verbose("foo\tbar\r\n"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if f.out.String() != "VERBOSE \"foo\tbar  \"\n" {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test saying of binary and filtered strings
+func TestSayAlphaVariants(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.SayAlphaBytes([]byte("ab\x00\xffc"), "")
+	a.SayAlphaFiltered("a-b_1.c", "#", unicode.IsLetter)
+	want := "SAY ALPHA \"ab00ffc\" \"\"\nSAY ALPHA \"abc\" \"#\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test automatic wrapping of full variable expressions
+func TestGetFullVariableExpr(t *testing.T) {
+	f := newFakeAsterisk("200 result=1 (foo)", "200 result=1 (bar)")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if r, err := a.GetFullVariableExpr("testagi"); err != nil || r.Dat != "foo" {
+		t.Errorf("Unexpected GetFullVariableExpr reply: %v %v", r, err)
+	}
+	a.GetFullVariableExpr("${CALLERID(num)}", "SIP/1")
+	want := "GET FULL VARIABLE \"${testagi}\"\nGET FULL VARIABLE \"${CALLERID(num)}\" \"SIP/1\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test saying of int64 numbers
+func TestSayNumberLarge(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.SayNumberLarge(9876543210, "#")
+	a.SayNumberLarge(-1, "", "f")
+	want := "SAY NUMBER \"9876543210\" \"#\"\nSAY NUMBER \"-1\" \"\" \"f\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test Music on hold toggling
+func TestSetMusicOnOff(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	a.SetMusicOn()
+	a.SetMusicOn("jazz")
+	a.SetMusicOff()
+	if _, err := a.SetMusicOn("ja\"zz"); err == nil {
+		t.Error("SetMusicOn failed to detect invalid class")
+	}
+	want := "SET MUSIC \"on\"\nSET MUSIC \"on\" \"jazz\"\nSET MUSIC \"off\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test typed TDD mode setting
+func TestSetTddMode(t *testing.T) {
+	f := newFakeAsterisk("200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if r, err := a.SetTddMode(TddMate); err != nil || r.Res != 1 {
+		t.Errorf("Unexpected SetTddMode reply: %v %v", r, err)
+	}
+	if _, err := a.SetTddMode("maybe"); err == nil {
+		t.Error("SetTddMode failed to detect invalid mode")
+	}
+	if f.out.String() != "TDD MODE \"mate\"\n" {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test autohangup with a duration
+func TestSetAutohangupDuration(t *testing.T) {
+	tests := []struct {
+		d   time.Duration
+		cmd string
+	}{
+		{-time.Second, "SET AUTOHANGUP \"0\"\n"},
+		{0, "SET AUTOHANGUP \"0\"\n"},
+		{999 * time.Millisecond, "SET AUTOHANGUP \"0\"\n"},
+		{time.Second, "SET AUTOHANGUP \"1\"\n"},
+		{1900 * time.Millisecond, "SET AUTOHANGUP \"1\"\n"},
+	}
+	for _, test := range tests {
+		f := newFakeAsterisk("200 result=0")
+		a := New()
+		if err := a.Init(f.rw()); err != nil {
+			t.Fatalf("Failed to initialize new AGI session: %v", err)
+		}
+		if _, err := a.SetAutohangupDuration(test.d); err != nil {
+			t.Errorf("Failed to set autohangup for %v: %v", test.d, err)
+		}
+		if f.out.String() != test.cmd {
+			t.Errorf("Unexpected command for %v: %q", test.d, f.out.String())
+		}
+	}
+}
+
+// Test loading of inline speech grammars through a temporary file
+func TestSpeechLoadGrammarInline(t *testing.T) {
+	f := newFakeAsterisk("200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if _, err := a.SpeechLoadGrammarInline("digits", ""); err == nil || f.out.Len() != 0 {
+		t.Errorf("Expecting empty grammar to fail without sending a command: %q %v", f.out.String(), err)
+	}
+	grammar := "#ABNF 1.0;\nroot $digit;\n$digit = one | two;\n"
+	prefix := "SPEECH LOAD GRAMMAR \"my \\\"digits\\\"\" "
+	var path string
+	a.SetHooks(Hooks{OnCommand: func(cmd string) {
+		if !strings.HasPrefix(cmd, prefix) {
+			t.Errorf("Unexpected command: %q", cmd)
+			return
+		}
+		var err error
+		if path, err = strconv.Unquote(strings.TrimPrefix(cmd, prefix)); err != nil {
+			t.Errorf("Grammar path not quoted: %q", cmd)
+			return
+		}
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != grammar {
+			t.Errorf("Unexpected grammar file content: %q %v", b, err)
+		}
+	}})
+	r, err := a.SpeechLoadGrammarInline("my \"digits\"", grammar)
+	if err != nil || r.Res != 1 {
+		t.Errorf("Failed to load inline grammar: %+v %v", r, err)
+	}
+	if path == "" {
+		t.Fatal("SPEECH LOAD GRAMMAR command not sent")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Grammar file not removed: %s %v", path, err)
+	}
+}
+
+// Test ReceiveChar with a duration timeout
+func TestReceiveCharDuration(t *testing.T) {
+	f := newFakeAsterisk("200 result=65")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	r, err := a.ReceiveCharDuration(1500 * time.Millisecond)
+	if c, ok, _ := ReceiveCharResult(r); err != nil || c != 'A' || !ok {
+		t.Errorf("Unexpected ReceiveCharDuration reply: %v %v", r, err)
+	}
+	if _, err = a.ReceiveCharDuration(-time.Second); err == nil {
+		t.Error("ReceiveCharDuration failed to detect negative timeout")
+	}
+	if f.out.String() != "RECEIVE CHAR 1500\n" {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test GetOption timeout variants
+func TestGetOptionTimeout(t *testing.T) {
+	f := newFakeAsterisk("200 result=0 endpos=1234", "200 result=49 endpos=567", "200 result=0 endpos=8")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	r, err := a.GetOptionWithTimeout("welcome", "1", 0)
+	if pos, perr := r.EndPos(); err != nil || perr != nil || pos != 1234 {
+		t.Errorf("Unexpected GetOptionWithTimeout reply: %v %v %v", r, err, perr)
+	}
+	r, err = a.GetOptionWithTimeout("welcome", "1", 2*time.Second)
+	if pos, _ := r.EndPos(); err != nil || r.Res != '1' || pos != 567 {
+		t.Errorf("Unexpected GetOptionWithTimeout reply: %v %v", r, err)
+	}
+	r, err = a.GetOptionNoTimeout("welcome", "1")
+	if pos, _ := r.EndPos(); err != nil || pos != 8 {
+		t.Errorf("Unexpected GetOptionNoTimeout reply: %v %v", r, err)
+	}
+	if _, err = a.GetOptionWithTimeout("welcome", "1", -time.Second); err == nil {
+		t.Error("GetOptionWithTimeout failed to detect negative timeout")
+	}
+	want := "GET OPTION \"welcome\" \"1\" 0\nGET OPTION \"welcome\" \"1\" 2000\nGET OPTION \"welcome\" \"1\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test validated and truncated text sending
+func TestSendTextSafe(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if _, err := a.SendTextSafe("καλημέρα", 5); err != nil {
+		t.Errorf("Failed to send text: %v", err)
+	}
+	if _, err := a.SendTextSafe("hello world", 0); err != nil {
+		t.Errorf("Failed to send text: %v", err)
+	}
+	for _, text := range []string{"foo\nbar", "foo\tbar", "\xff"} {
+		if _, err := a.SendTextSafe(text, 0); err == nil {
+			t.Errorf("SendTextSafe failed to detect invalid text %q", text)
+		}
+	}
+	want := "SEND TEXT \"κα\"\nSEND TEXT \"hello world\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test setting of extensions
+func TestSetExtension(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if _, err := a.SetExtensionInt(1001); err != nil {
+		t.Errorf("Failed to set extension: %v", err)
+	}
+	if _, err := a.SetExtension("s"); err != nil {
+		t.Errorf("Failed to set extension: %v", err)
+	}
+	for _, ext := range []string{"100;1", "100\n"} {
+		if _, err := a.SetExtension(ext); err == nil {
+			t.Errorf("SetExtension failed to detect invalid extension %q", ext)
+		}
+	}
+	want := "SET EXTENSION \"1001\"\nSET EXTENSION \"s\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test validation of the AGI environment content
+func TestValidateEnv(t *testing.T) {
+	a := New()
+	a.Init(newFakeAsterisk().rw())
+	if err := ValidateEnv(a); err != nil {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+	a.Env["context"] = ""
+	a.Env["priority"] = "0"
+	a.Env["enhanced"] = "yes"
+	a.Env["version"] = "trunk"
+	err := ValidateEnv(a)
+	if err == nil {
+		t.Fatal("ValidateEnv failed to detect invalid environment")
+	}
+	for _, key := range []string{"agi_context", "agi_priority", "agi_enhanced", "agi_version"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expecting %s violation to be reported, got: %v", key, err)
+		}
+	}
+	for _, v := range []string{"18.2.0", "13.1-cert2", "16.28.0~dfsg-0+deb11u3"} {
+		if !versionPattern.MatchString(v) {
+			t.Errorf("Expecting version %s to be valid", v)
+		}
+	}
+}
+
+// Test asterisk version parsing and command support
+func TestParsedVersion(t *testing.T) {
+	a := New()
+	tests := []struct {
+		version             string
+		major, minor, patch int
+		valid               bool
+	}{
+		{"18.5.0", 18, 5, 0, true},
+		{"1.8.32.3", 1, 8, 32, true},
+		{"13.1-cert2", 13, 1, 0, true},
+		{"16.28.0~dfsg-0+deb11u3", 16, 28, 0, true},
+		{"SVN-trunk-r12345", 0, 0, 0, false},
+		{"18", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+	for _, tc := range tests {
+		a.Env["version"] = tc.version
+		major, minor, patch, err := a.ParsedVersion()
+		if (err == nil) != tc.valid || major != tc.major || minor != tc.minor || patch != tc.patch {
+			t.Errorf("Error parsing version %q: %d %d %d %v", tc.version, major, minor, patch, err)
+		}
+	}
+	a.Env["version"] = "1.4.44"
+	if ok, err := a.SupportsCommand("SPEECH CREATE lumenvox", ""); ok || err != nil {
+		t.Errorf("Expecting SPEECH CREATE to be unsupported, got: %v %v", ok, err)
+	}
+	if ok, err := a.SupportsCommand("ANSWER", ""); !ok || err != nil {
+		t.Errorf("Expecting ANSWER to be supported, got: %v %v", ok, err)
+	}
+	a.Env["version"] = "18.5.0"
+	if ok, err := a.SupportsCommand("gosub", ""); !ok || err != nil {
+		t.Errorf("Expecting GOSUB to be supported, got: %v %v", ok, err)
+	}
+	if ok, err := a.SupportsCommand("FOO", "18.5.1"); ok || err != nil {
+		t.Errorf("Expecting FOO to be unsupported, got: %v %v", ok, err)
+	}
+	if _, err := a.SupportsCommand("FOO", "latest"); err == nil {
+		t.Error("SupportsCommand failed to detect invalid minimum version")
+	}
+}
+
+// Test comparing AGI environments
+func TestEnvDiff(t *testing.T) {
+	a, b := New(), New()
+	a.Env = map[string]string{"channel": "SIP/1", "context": "default", "arg_1": "foo", "extension": "100"}
+	b.Env = map[string]string{"channel": "SIP/1", "context": "ivr", "arg_2": "bar", "extension": ""}
+	diff := a.EnvDiff(b)
+	expected := map[string]string{"context": "ivr", "arg_1": "", "arg_2": "bar", "extension": ""}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expecting diff: %v, got: %v", expected, diff)
+	}
+	if diff = a.EnvDiff(a); len(diff) != 0 {
+		t.Errorf("Expecting empty diff, got: %v", diff)
+	}
+}
+
+// Test populating a struct from the AGI environment
+func TestUnmarshalArgs(t *testing.T) {
+	a := New()
+	a.Env = map[string]string{"arg_1": "foo", "arg_2": "42", "arg_3": "true", "arg_4": "1.5", "channel": "SIP/1"}
+	var cfg struct {
+		File    string  `agi:"arg_1"`
+		Count   int     `agi:"arg_2"`
+		Loop    bool    `agi:"arg_3"`
+		Gain    float64 `agi:"arg_4"`
+		Channel string  `agi:"channel"`
+		Missing string  `agi:"arg_5"`
+		Skip    string  `agi:"-"`
+	}
+	cfg.Missing = "default"
+	if err := a.UnmarshalArgs(&cfg); err != nil {
+		t.Fatalf("Failed to unmarshal args: %v", err)
+	}
+	if cfg.File != "foo" || cfg.Count != 42 || !cfg.Loop || cfg.Gain != 1.5 || cfg.Channel != "SIP/1" ||
+		cfg.Missing != "default" || cfg.Skip != "" {
+		t.Errorf("Error unmarshaling args: %+v", cfg)
+	}
+	a.Env["arg_2"] = "n"
+	if err := a.UnmarshalArgs(&cfg); err == nil {
+		t.Error("UnmarshalArgs failed to detect invalid agi_arg_2")
+	}
+	if err := a.UnmarshalArgs(cfg); err == nil {
+		t.Error("UnmarshalArgs failed to detect non-pointer target")
+	}
+}
+
+// Test the limit of AGI environment variables
+func TestEnvMax(t *testing.T) {
+	a := New(WithEnvMax(20))
+	if err := a.Init(newFakeAsterisk().rw()); err == nil {
+		t.Errorf("Environment larger than EnvMax was accepted: %v", a.Env)
+	}
+	a = New(WithEnvMax(25))
+	if err := a.Init(newFakeAsterisk().rw()); err != nil || len(a.Env) != 25 {
+		t.Errorf("Failed to parse environment within EnvMax: %v", err)
+	}
+}
+
+// Test stalled AGI environment reception
+func TestInitWithTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(env[:bytes.Index(env, []byte("agi_callerid"))])
+	a := New()
+	err := a.InitWithTimeout(bufio.NewReadWriter(bufio.NewReader(pr), bufio.NewWriter(ioutil.Discard)), 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expecting deadline exceeded error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "after 8 env vars") {
+		t.Errorf("Error doesn't report the parsed env vars: %v", err)
+	}
+}
+
+// Test dialplan subroutine execution
+func TestGoSub(t *testing.T) {
+	f := newFakeAsterisk("200 result=0 Gosub complete", "200 result=1 (42)", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	r, err := a.GoSubNoArgs("sub", "s", "1")
+	if err != nil || r.Dat != "Gosub complete" {
+		t.Errorf("Unexpected GoSub reply: %+v %v", r, err)
+	}
+	if v, err := a.GoSubReturnValue(); err != nil || v != "42" {
+		t.Errorf("Unexpected GoSub return value: %s %v", v, err)
+	}
+	if _, err := a.GoSubReturnValue(); !errors.Is(err, ErrVariableNotSet{}) {
+		t.Errorf("Expecting ErrVariableNotSet error, got: %v", err)
+	}
+	want := "GOSUB \"sub\" \"s\" \"1\" \"\"\nGET VARIABLE \"GOSUB_RETVAL\"\nGET VARIABLE \"GOSUB_RETVAL\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+// Package agitest provides utilities for unit testing AGI applications without asterisk.
+package agitest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/zaf/agi"
+)
+
+// MockSession is an agi.Session connected to a fake asterisk instead of a real channel.
+// Every AGI command sent is recorded and answered with the next canned reply, once the
+// replies run out commands fail with io.EOF. It satisfies agi.SessionInterface.
+type MockSession struct {
+	*agi.Session
+	ast *fakeAsterisk
+}
+
+var _ agi.SessionInterface = (*MockSession)(nil)
+
+// DefaultEnv returns the AGI environment of new mock sessions, without the agi_ prefix of the keys.
+func DefaultEnv() map[string]string {
+	return map[string]string{
+		"network":        "yes",
+		"network_script": "test",
+		"request":        "agi://127.0.0.1/test",
+		"channel":        "SIP/1234-00000000",
+		"language":       "en",
+		"type":           "SIP",
+		"uniqueid":       "1397044468.0",
+		"version":        "13.0.0",
+		"callerid":       "1001",
+		"calleridname":   "1001",
+		"callingpres":    "0",
+		"callingani2":    "0",
+		"callington":     "0",
+		"callingtns":     "0",
+		"dnid":           "1002",
+		"rdnis":          "unknown",
+		"context":        "default",
+		"extension":      "1002",
+		"priority":       "1",
+		"enhanced":       "0.0",
+		"accountcode":    "",
+		"threadid":       "1",
+	}
+}
+
+// NewMockSession returns a new MockSession with the default environment that answers
+// AGI commands with the given replies, in order.
+func NewMockSession(replies ...agi.Reply) *MockSession {
+	return NewMockSessionBuilder().Replies(replies...).Build()
+}
+
+// SetResponses replaces the pending canned replies.
+func (m *MockSession) SetResponses(replies []agi.Reply) {
+	lines := make([]string, len(replies))
+	for i, r := range replies {
+		lines[i] = replyLine(r)
+	}
+	m.ast.setReplies(lines)
+}
+
+// SentCommands returns the AGI commands sent so far, in order.
+func (m *MockSession) SentCommands() []string {
+	return m.ast.sentCommands()
+}
+
+// MockSessionBuilder builds MockSessions with a custom environment and replies.
+type MockSessionBuilder struct {
+	env   map[string]string
+	lines []string
+}
+
+// NewMockSessionBuilder returns a new MockSessionBuilder starting with the default environment.
+func NewMockSessionBuilder() *MockSessionBuilder {
+	return &MockSessionBuilder{env: DefaultEnv()}
+}
+
+// Env sets the AGI environment variable key, given without the agi_ prefix.
+func (b *MockSessionBuilder) Env(key, value string) *MockSessionBuilder {
+	b.env[key] = value
+	return b
+}
+
+// Args sets the AGI script arguments agi_arg_1, agi_arg_2, ... to args.
+func (b *MockSessionBuilder) Args(args ...string) *MockSessionBuilder {
+	for i, arg := range args {
+		b.env[fmt.Sprintf("arg_%d", i+1)] = arg
+	}
+	return b
+}
+
+// Reply appends a 200 reply with the given result and data.
+func (b *MockSessionBuilder) Reply(res int, dat string) *MockSessionBuilder {
+	return b.Replies(agi.Reply{Res: res, Dat: dat})
+}
+
+// Replies appends 200 replies.
+func (b *MockSessionBuilder) Replies(replies ...agi.Reply) *MockSessionBuilder {
+	for _, r := range replies {
+		b.lines = append(b.lines, replyLine(r))
+	}
+	return b
+}
+
+// Hangup appends a HANGUP request, failing the next command like a channel hang-up.
+func (b *MockSessionBuilder) Hangup() *MockSessionBuilder {
+	return b.Raw("HANGUP")
+}
+
+// Raw appends a raw protocol line, like "510 Invalid or unknown command".
+func (b *MockSessionBuilder) Raw(line string) *MockSessionBuilder {
+	b.lines = append(b.lines, line)
+	return b
+}
+
+// Build returns a new initialized MockSession. It panics if the environment is incomplete.
+func (b *MockSessionBuilder) Build() *MockSession {
+	keys := make([]string, 0, len(b.env))
+	for k := range b.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ast := new(fakeAsterisk)
+	for _, k := range keys {
+		fmt.Fprintf(&ast.in, "agi_%s: %s\n", k, b.env[k])
+	}
+	ast.in.WriteString("\n")
+	ast.setReplies(b.lines)
+	m := &MockSession{Session: agi.New(), ast: ast}
+	if err := m.InitRW(ast, ast); err != nil {
+		panic("agitest: " + err.Error())
+	}
+	return m
+}
+
+func replyLine(r agi.Reply) string {
+	if r.Dat == "" {
+		return fmt.Sprintf("200 result=%d", r.Res)
+	}
+	return fmt.Sprintf("200 result=%d %s", r.Res, r.Dat)
+}
+
+// fakeAsterisk plays the asterisk side of a session, releasing one reply line for every command line.
+type fakeAsterisk struct {
+	mu      sync.Mutex
+	in      bytes.Buffer
+	partial []byte
+	replies []string
+	sent    []string
+}
+
+func (f *fakeAsterisk) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.in.Len() == 0 {
+		return 0, io.EOF
+	}
+	return f.in.Read(p)
+}
+
+func (f *fakeAsterisk) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.partial = append(f.partial, p...)
+	for {
+		i := bytes.IndexByte(f.partial, '\n')
+		if i < 0 {
+			break
+		}
+		f.sent = append(f.sent, string(f.partial[:i]))
+		f.partial = f.partial[i+1:]
+		if len(f.replies) > 0 {
+			f.in.WriteString(f.replies[0] + "\n")
+			f.replies = f.replies[1:]
+		}
+	}
+	return len(p), nil
+}
+
+func (f *fakeAsterisk) setReplies(lines []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = append([]string(nil), lines...)
+}
+
+func (f *fakeAsterisk) sentCommands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent...)
+}
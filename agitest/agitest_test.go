@@ -0,0 +1,47 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agitest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zaf/agi"
+)
+
+// playback is a sample AGI application coded against agi.SessionInterface.
+func playback(s agi.SessionInterface, file string) error {
+	if _, err := s.Answer(); err != nil {
+		return err
+	}
+	_, err := s.StreamFile(file, "")
+	return err
+}
+
+func TestMockSession(t *testing.T) {
+	m := NewMockSession(agi.Reply{Res: 0}, agi.Reply{Res: 0, Dat: "endpos=1234"})
+	if err := playback(m, "hello"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sent := m.SentCommands()
+	if len(sent) != 2 || sent[0] != "ANSWER" || sent[1] != `STREAM FILE "hello" ""` {
+		t.Errorf("Unexpected commands: %q", sent)
+	}
+	m.SetResponses([]agi.Reply{{Res: -1}})
+	if r, err := m.Answer(); err != nil || r.Res != -1 {
+		t.Errorf("Unexpected reply: %+v %v", r, err)
+	}
+}
+
+func TestMockSessionBuilder(t *testing.T) {
+	m := NewMockSessionBuilder().Env("channel", "PJSIP/100-00000001").Args("foo", "bar").Reply(0, "").Hangup().Build()
+	if m.Channel() != "PJSIP/100-00000001" || m.Arg(2) != "bar" {
+		t.Errorf("Unexpected environment: %v", m.Env)
+	}
+	if err := playback(m, "hello"); !errors.Is(err, agi.ErrHangupResponse) {
+		t.Errorf("Expecting hangup error, got: %v", err)
+	}
+}
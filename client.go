@@ -0,0 +1,118 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is the asterisk side of a FastAGI connection, as created by DialFastAGI.
+// It reads the AGI commands sent by the FastAGI server and writes back their replies.
+type Client struct {
+	Env map[string]string // AGI environment sent to the server, keys without the agi_ prefix.
+
+	conn net.Conn
+	buf  *bufio.ReadWriter
+	ctx  context.Context
+	done chan struct{} // Closed by Close, stops watching ctx.
+	once sync.Once
+}
+
+// DialFastAGI connects to the FastAGI server at the TCP address addr, playing the asterisk side
+// of the protocol, and sends it the AGI environment env. Keys of env are given without the agi_
+// prefix, like in Session.Env. The ctx covers the whole exchange: once it is cancelled or its
+// deadline expires, pending and future reads and writes of the Client fail. The Client must be
+// closed with Close when done.
+func DialFastAGI(ctx context.Context, addr string, env map[string]string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		Env:  make(map[string]string, len(env)),
+		conn: conn,
+		buf:  bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				// Unblock any pending read or write.
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-c.done:
+			}
+		}()
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sanitize := strings.NewReplacer("\r", " ", "\n", " ")
+	for _, k := range keys {
+		key := strings.TrimPrefix(k, "agi_")
+		value := sanitize.Replace(env[k])
+		c.Env[key] = value
+		c.buf.WriteString("agi_" + key + ": " + value + "\n")
+	}
+	c.buf.WriteString("\n")
+	if err = c.buf.Flush(); err != nil {
+		c.Close()
+		return nil, c.error(err)
+	}
+	return c, nil
+}
+
+// ReadCommand reads the next AGI command sent by the FastAGI server, without the trailing newline.
+// It returns io.EOF once the server closes the connection.
+func (c *Client) ReadCommand() (string, error) {
+	line, err := c.buf.ReadBytes(10)
+	if err != nil {
+		return "", c.error(err)
+	}
+	return string(bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))), nil
+}
+
+// WriteReply writes the 200 reply of an AGI command, with the result r.Res followed by r.Dat if set.
+func (c *Client) WriteReply(r Reply) error {
+	if r.Dat == "" {
+		return c.WriteLine(fmt.Sprintf("200 result=%d", r.Res))
+	}
+	return c.WriteLine(fmt.Sprintf("200 result=%d %s", r.Res, r.Dat))
+}
+
+// WriteLine writes a raw response line, like "510 Invalid or unknown command" or "HANGUP".
+func (c *Client) WriteLine(line string) error {
+	if _, err := c.buf.WriteString(line + "\n"); err != nil {
+		return c.error(err)
+	}
+	return c.error(c.buf.Flush())
+}
+
+// Close closes the connection to the FastAGI server.
+func (c *Client) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.conn.Close()
+}
+
+// error returns the context error instead of err if the context of the client is done.
+func (c *Client) error(err error) error {
+	if err != nil && c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return err
+}
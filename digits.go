@@ -0,0 +1,85 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import "strings"
+
+// Digit is a DTMF digit, or a sequence of them, as used in the escape digits of AGI commands.
+type Digit string
+
+// DTMF digits.
+const (
+	Digits0    Digit = "0"
+	Digits1    Digit = "1"
+	Digits2    Digit = "2"
+	Digits3    Digit = "3"
+	Digits4    Digit = "4"
+	Digits5    Digit = "5"
+	Digits6    Digit = "6"
+	Digits7    Digit = "7"
+	Digits8    Digit = "8"
+	Digits9    Digit = "9"
+	DigitStar  Digit = "*"
+	DigitPound Digit = "#"
+)
+
+const (
+	numericDigits = "0123456789"
+	allDigits     = numericDigits + "*#"
+)
+
+// DigitSet builds escape digit strings. The zero value is an empty set.
+// Duplicates are ignored and the digits are always listed in the order 0-9, * and #.
+// Pass it to StreamFileDigits or GetOptionDigits, or String() as the escape argument
+// of other commands.
+type DigitSet struct {
+	digits uint16 // Bit i is set if allDigits[i] is in the set.
+}
+
+// Add adds the given digits to the set and returns it, so calls can be chained.
+// Characters that are not DTMF digits are ignored.
+func (s *DigitSet) Add(d ...Digit) *DigitSet {
+	for _, seq := range d {
+		for _, c := range seq {
+			if i := strings.IndexRune(allDigits, c); i >= 0 {
+				s.digits |= 1 << uint(i)
+			}
+		}
+	}
+	return s
+}
+
+// All returns all the DTMF digits, "0123456789*#". The set is not modified.
+func (s DigitSet) All() Digit {
+	return allDigits
+}
+
+// Numeric returns the numeric DTMF digits, "0123456789". The set is not modified.
+func (s DigitSet) Numeric() Digit {
+	return numericDigits
+}
+
+// String returns the digits of the set as an escape digits string.
+func (s DigitSet) String() string {
+	var b strings.Builder
+	for i := 0; i < len(allDigits); i++ {
+		if s.digits&(1<<uint(i)) != 0 {
+			b.WriteByte(allDigits[i])
+		}
+	}
+	return b.String()
+}
+
+// StreamFileDigits plays audio file like StreamFile, with escape digits given as a DigitSet.
+func (a *Session) StreamFileDigits(file string, escape DigitSet, offset ...int) (Reply, error) {
+	return a.StreamFile(file, escape.String(), offset...)
+}
+
+// GetOptionDigits behaves similar to StreamFile but used with a timeout option, like GetOption,
+// with escape digits given as a DigitSet.
+func (a *Session) GetOptionDigits(filename string, escape DigitSet, timeout ...int) (Reply, error) {
+	return a.GetOption(filename, escape.String(), timeout...)
+}
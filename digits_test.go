@@ -0,0 +1,53 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import "testing"
+
+// Test building of escape digit strings
+func TestDigitSet(t *testing.T) {
+	var s DigitSet
+	if d := s.Add(DigitStar, Digits1, "1#x", Digits0).String(); d != "01*#" {
+		t.Errorf("Error adding digits. Expecting: 01*#, got: %s", d)
+	}
+	if d := s.Numeric(); d != "0123456789" {
+		t.Errorf("Error getting numeric digits. Expecting: 0123456789, got: %s", d)
+	}
+	if d := s.All(); d != "0123456789*#" {
+		t.Errorf("Error getting all digits. Expecting: 0123456789*#, got: %s", d)
+	}
+	if d := s.String(); d != "01*#" {
+		t.Errorf("Digit set modified. Expecting: 01*#, got: %s", d)
+	}
+	if d := new(DigitSet).Add(s.Numeric()).String(); d != "0123456789" {
+		t.Errorf("Error adding numeric digits. Expecting: 0123456789, got: %s", d)
+	}
+	if d := new(DigitSet).String(); d != "" {
+		t.Errorf("Expecting empty digit set, got: %s", d)
+	}
+}
+
+// Test playback commands with typed escape digits
+func TestStreamFileDigits(t *testing.T) {
+	f := newFakeAsterisk("200 result=0 endpos=1234", "200 result=35 endpos=100")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	var s DigitSet
+	s.Add(DigitPound, Digits9)
+	if _, err := a.StreamFileDigits("welcome", s); err != nil {
+		t.Errorf("Failed to send STREAM FILE command: %v", err)
+	}
+	r, err := a.GetOptionDigits("menu", s, 2000)
+	if err != nil || r.Res != 35 {
+		t.Errorf("Failed to send GET OPTION command: %v %+v", err, r)
+	}
+	cmds := "STREAM FILE \"welcome\" \"9#\"\nGET OPTION \"menu\" \"9#\" 2000\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
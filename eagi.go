@@ -0,0 +1,34 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// EAGISession is an Extended AGI session. Along with the AGI commands it provides the audio
+// of the channel, which asterisk streams to EAGI scripts over file descriptor 3.
+type EAGISession struct {
+	*Session
+	AudioReader io.Reader // Raw audio from the channel, signed linear 8kHz mono by default.
+}
+
+// NewEAGI creates a new EAGISession and returns a pointer to it.
+func NewEAGI() *EAGISession {
+	return &EAGISession{Session: New()}
+}
+
+// InitEAGI initializes a new EAGI session like Init. If audio is nil the audio is read from
+// file descriptor 3, as set up by asterisk for EAGI scripts.
+func (e *EAGISession) InitEAGI(rw *bufio.ReadWriter, audio io.Reader) error {
+	if audio == nil {
+		audio = os.NewFile(3, "eagi")
+	}
+	e.AudioReader = audio
+	return e.Init(rw)
+}
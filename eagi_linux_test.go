@@ -0,0 +1,50 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+//go:build linux
+// +build linux
+
+package agi
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Test EAGI session initialization with the audio of file descriptor 3
+func TestInitEAGIFd(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+	// Keep whatever is open on fd 3 and restore it afterwards.
+	if saved, err := unix.Dup(3); err == nil {
+		defer func() {
+			unix.Dup2(saved, 3)
+			unix.Close(saved)
+		}()
+	}
+	if err := unix.Dup2(int(pr.Fd()), 3); err != nil {
+		t.Fatalf("Failed to set up fd 3: %v", err)
+	}
+	e := NewEAGI()
+	if err := e.InitEAGI(newFakeAsterisk().rw(), nil); err != nil {
+		unix.Close(3)
+		t.Fatalf("Failed to initialize new EAGI session: %v", err)
+	}
+	// Closes fd 3 before it is restored.
+	defer e.AudioReader.(*os.File).Close()
+	pw.Write([]byte("audio"))
+	pw.Close()
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(e.AudioReader, b); err != nil || string(b) != "audio" {
+		t.Errorf("Unexpected audio from fd 3: %q %v", b, err)
+	}
+}
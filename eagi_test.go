@@ -0,0 +1,32 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Test EAGI session initialization with an audio reader
+func TestInitEAGI(t *testing.T) {
+	f := newFakeAsterisk("200 result=1")
+	e := NewEAGI()
+	audio := strings.NewReader("audio")
+	if err := e.InitEAGI(f.rw(), audio); err != nil {
+		t.Fatalf("Failed to initialize new EAGI session: %v", err)
+	}
+	if e.Env["channel"] != "SIP/1234-00000000" {
+		t.Errorf("Unexpected EAGI session environment: %v", e.Env)
+	}
+	if b, err := ioutil.ReadAll(e.AudioReader); err != nil || string(b) != "audio" {
+		t.Errorf("Unexpected audio: %q %v", b, err)
+	}
+	r, err := e.Answer()
+	if err != nil || r.Res != 1 || f.out.String() != "ANSWER\n" {
+		t.Errorf("Failed to send AGI command: %q %+v %v", f.out.String(), r, err)
+	}
+}
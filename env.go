@@ -0,0 +1,423 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AGIEnv holds the standard AGI environment variables of a session in typed form.
+// It encodes to JSON using the AGI variable names without the agi_ prefix as keys.
+type AGIEnv struct {
+	Network       bool     `json:"network"`        // agi_network, true for FastAGI sessions.
+	NetworkScript string   `json:"network_script"` // agi_network_script
+	Request       string   `json:"request"`        // agi_request
+	Channel       string   `json:"channel"`        // agi_channel
+	Language      string   `json:"language"`       // agi_language
+	Type          string   `json:"type"`           // agi_type
+	UniqueID      string   `json:"uniqueid"`       // agi_uniqueid
+	Version       string   `json:"version"`        // agi_version
+	CallerID      string   `json:"callerid"`       // agi_callerid
+	CallerIDName  string   `json:"calleridname"`   // agi_calleridname
+	CallingPres   int      `json:"callingpres"`    // agi_callingpres
+	DNID          string   `json:"dnid"`           // agi_dnid
+	RDNIS         string   `json:"rdnis"`          // agi_rdnis
+	Context       string   `json:"context"`        // agi_context
+	Extension     string   `json:"extension"`      // agi_extension
+	Priority      int      `json:"priority"`       // agi_priority
+	Enhanced      bool     `json:"enhanced"`       // agi_enhanced, true for EAGI sessions.
+	AccountCode   string   `json:"accountcode"`    // agi_accountcode
+	ThreadID      int64    `json:"threadid"`       // agi_threadid
+	Args          []string `json:"args"`           // agi_arg_1, agi_arg_2, ...
+}
+
+// Channel returns the originating channel (agi_channel).
+func (a *Session) Channel() string {
+	return a.Env["channel"]
+}
+
+// Language returns the language code of the channel (agi_language).
+func (a *Session) Language() string {
+	return a.Env["language"]
+}
+
+// UniqueID returns the unique ID of the channel (agi_uniqueid).
+func (a *Session) UniqueID() string {
+	return a.Env["uniqueid"]
+}
+
+// Request returns the requested AGI script or FastAGI URL (agi_request).
+func (a *Session) Request() string {
+	return a.Env["request"]
+}
+
+// Type returns the originating channel type (agi_type).
+func (a *Session) Type() string {
+	return a.Env["type"]
+}
+
+// Version returns the asterisk version (agi_version).
+func (a *Session) Version() string {
+	return a.Env["version"]
+}
+
+// ParsedVersion returns the major, minor and patch numbers of the asterisk version (agi_version).
+// Any suffix after the numbers, like -cert2 or ~dfsg, is ignored and a missing patch number is 0.
+func (a *Session) ParsedVersion() (major, minor, patch int, err error) {
+	return parseVersion(a.Env["version"])
+}
+
+// parseVersion parses the leading major.minor[.patch] numbers of version.
+func parseVersion(version string) (major, minor, patch int, err error) {
+	var nums [3]int
+	rest := version
+	for i := range nums {
+		end := 0
+		for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			if i < 2 {
+				return 0, 0, 0, fmt.Errorf("invalid version: %q", version)
+			}
+			break
+		}
+		nums[i], _ = strconv.Atoi(rest[:end])
+		rest = rest[end:]
+		if !strings.HasPrefix(rest, ".") {
+			if i < 1 {
+				return 0, 0, 0, fmt.Errorf("invalid version: %q", version)
+			}
+			break
+		}
+		rest = rest[1:]
+	}
+	return nums[0], nums[1], nums[2], nil
+}
+
+// commandVersions holds the minimum asterisk version of AGI commands that are not available
+// in all versions.
+var commandVersions = map[string]string{
+	"ASYNCAGI BREAK":            "1.6.0",
+	"GOSUB":                     "1.6.0",
+	"SPEECH CREATE":             "1.6.0",
+	"SPEECH SET":                "1.6.0",
+	"SPEECH DESTROY":            "1.6.0",
+	"SPEECH LOAD GRAMMAR":       "1.6.0",
+	"SPEECH UNLOAD GRAMMAR":     "1.6.0",
+	"SPEECH ACTIVATE GRAMMAR":   "1.6.0",
+	"SPEECH DEACTIVATE GRAMMAR": "1.6.0",
+	"SPEECH RECOGNIZE":          "1.6.0",
+}
+
+// SupportsCommand reports whether the asterisk version of the session is at least minVersion, the
+// minimum version required by the AGI command cmd. If minVersion is empty the minimum version is
+// looked up by the command name, with or without arguments, in a built-in table of commands that
+// are not available in all versions. Commands missing from it are assumed to be supported
+// by all versions. An error is returned if either version can't be parsed.
+func (a *Session) SupportsCommand(cmd string, minVersion string) (bool, error) {
+	if minVersion == "" {
+		name := strings.ToUpper(strings.TrimSpace(cmd))
+		for c, v := range commandVersions {
+			if name == c || strings.HasPrefix(name, c+" ") {
+				minVersion = v
+				break
+			}
+		}
+		if minVersion == "" {
+			return true, nil
+		}
+	}
+	reqMajor, reqMinor, reqPatch, err := parseVersion(minVersion)
+	if err != nil {
+		return false, err
+	}
+	major, minor, patch, err := a.ParsedVersion()
+	if err != nil {
+		return false, err
+	}
+	if major != reqMajor {
+		return major > reqMajor, nil
+	}
+	if minor != reqMinor {
+		return minor > reqMinor, nil
+	}
+	return patch >= reqPatch, nil
+}
+
+// CallerID returns the caller ID number (agi_callerid).
+func (a *Session) CallerID() string {
+	return a.Env["callerid"]
+}
+
+// CallerIDName returns the caller ID name (agi_calleridname).
+func (a *Session) CallerIDName() string {
+	return a.Env["calleridname"]
+}
+
+// ParseCallerID splits a raw callerid string like "Name <number>" or "\"Name\" <number>" into
+// its name and number. A string without angle brackets is taken as a number if it consists of
+// dialable characters (digits, +, *, #) and as a name otherwise. The callerid of the session is
+// already available split in CallerIDName and CallerID.
+func ParseCallerID(cid string) (name, number string) {
+	cid = strings.TrimSpace(cid)
+	if lt := strings.LastIndexByte(cid, '<'); lt >= 0 && strings.HasSuffix(cid, ">") {
+		number = strings.TrimSpace(cid[lt+1 : len(cid)-1])
+		name = strings.TrimSpace(cid[:lt])
+		if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+			name = name[1 : len(name)-1]
+		}
+		return name, number
+	}
+	if cid != "" && strings.Trim(cid, "0123456789+*#") == "" {
+		return "", cid
+	}
+	return strings.Trim(cid, `"`), ""
+}
+
+// Context returns the dialplan context the AGI was called from (agi_context).
+func (a *Session) Context() string {
+	return a.Env["context"]
+}
+
+// Extension returns the dialplan extension the AGI was called from (agi_extension).
+func (a *Session) Extension() string {
+	return a.Env["extension"]
+}
+
+// Priority returns the dialplan priority the AGI was called from (agi_priority).
+func (a *Session) Priority() string {
+	return a.Env["priority"]
+}
+
+// AccountCode returns the account code of the channel (agi_accountcode).
+func (a *Session) AccountCode() string {
+	return a.Env["accountcode"]
+}
+
+// Args returns the arguments passed to the AGI script (agi_arg_1, agi_arg_2, ...) in ascending
+// order, stopping at the first gap in the sequence.
+func (a *Session) Args() []string {
+	var args []string
+	for i := 1; ; i++ {
+		arg, ok := a.Env["arg_"+strconv.Itoa(i)]
+		if !ok {
+			break
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// Arg returns the nth argument passed to the AGI script (agi_arg_n), counting from 1.
+// It returns an empty string if there is no such argument.
+func (a *Session) Arg(n int) string {
+	return a.Env["arg_"+strconv.Itoa(n)]
+}
+
+// EnvDiff compares the AGI environment of the session to that of other, typically a later
+// snapshot, and returns the variables whose values differ, mapped to their value in other.
+// Variables missing from other are mapped to an empty string.
+func (a *Session) EnvDiff(other *Session) map[string]string {
+	diff := make(map[string]string)
+	for k, v := range a.Env {
+		if ov, ok := other.Env[k]; !ok || ov != v {
+			diff[k] = ov
+		}
+	}
+	for k, v := range other.Env {
+		if _, ok := a.Env[k]; !ok {
+			diff[k] = v
+		}
+	}
+	return diff
+}
+
+// versionPattern matches semver-like asterisk versions, like 18.2.0 or 13.1-cert2.
+var versionPattern = regexp.MustCompile(`^\d+\.\d+(\.\d+)?([-.~+]\S*)?$`)
+
+// ValidateEnv checks the content of the AGI environment of a, as parsed by Init: the channel,
+// uniqueid, context, extension and priority variables must be set, agi_priority must be a positive
+// integer, agi_enhanced, if set, must be 0.0 or 1.0, and agi_version must be a semver-like version.
+// All violations found are returned joined in a single error, nil if there are none.
+func ValidateEnv(a *Session) error {
+	var errs []error
+	for _, key := range []string{"channel", "uniqueid", "context", "extension", "priority"} {
+		if a.Env[key] == "" {
+			errs = append(errs, fmt.Errorf("missing agi_%s", key))
+		}
+	}
+	if v := a.Env["priority"]; v != "" {
+		if p, err := strconv.Atoi(v); err != nil || p <= 0 {
+			errs = append(errs, fmt.Errorf("invalid agi_priority: %q is not a positive integer", v))
+		}
+	}
+	if v, ok := a.Env["enhanced"]; ok && v != "0.0" && v != "1.0" {
+		errs = append(errs, fmt.Errorf("invalid agi_enhanced: %q", v))
+	}
+	if v := a.Env["version"]; !versionPattern.MatchString(v) {
+		errs = append(errs, fmt.Errorf("invalid agi_version: %q", v))
+	}
+	return joinErrors(errs)
+}
+
+// ParsedEnv returns the AGI environment of the session as an AGIEnv. Numeric and boolean
+// variables that are missing are left to their zero value. If a variable fails to parse the
+// remaining ones are still converted and the first error is returned.
+func (a *Session) ParsedEnv() (AGIEnv, error) {
+	env := AGIEnv{
+		Network:       a.Env["network"] == "yes" || a.Env["network"] == "tls",
+		NetworkScript: a.Env["network_script"],
+		Request:       a.Env["request"],
+		Channel:       a.Env["channel"],
+		Language:      a.Env["language"],
+		Type:          a.Env["type"],
+		UniqueID:      a.Env["uniqueid"],
+		Version:       a.Env["version"],
+		CallerID:      a.Env["callerid"],
+		CallerIDName:  a.Env["calleridname"],
+		DNID:          a.Env["dnid"],
+		RDNIS:         a.Env["rdnis"],
+		Context:       a.Env["context"],
+		Extension:     a.Env["extension"],
+		AccountCode:   a.Env["accountcode"],
+		Args:          a.Args(),
+	}
+	var err, perr error
+	check := func(key string) {
+		if perr != nil && err == nil {
+			err = fmt.Errorf("invalid agi_%s: %w", key, perr)
+		}
+	}
+	if v := a.Env["callingpres"]; v != "" {
+		env.CallingPres, perr = strconv.Atoi(v)
+		check("callingpres")
+	}
+	if v := a.Env["priority"]; v != "" {
+		env.Priority, perr = strconv.Atoi(v)
+		check("priority")
+	}
+	if v := a.Env["enhanced"]; v != "" {
+		var f float64
+		f, perr = strconv.ParseFloat(v, 64)
+		env.Enhanced = f != 0
+		check("enhanced")
+	}
+	if v := a.Env["threadid"]; v != "" {
+		env.ThreadID, perr = strconv.ParseInt(v, 10, 64)
+		check("threadid")
+	}
+	return env, err
+}
+
+// UnmarshalArgs populates the fields of the struct pointed to by v from the AGI environment,
+// using struct tags holding the variable name without the agi_ prefix, like `agi:"arg_1"`.
+// Fields of string, bool, integer and floating point kinds are supported, values are converted
+// using the strconv package. Untagged fields, fields tagged with "-" and fields whose variable
+// is missing from the environment are left unchanged.
+func (a *Session) UnmarshalArgs(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("unmarshal target must be a non-nil pointer to a struct")
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		key := rt.Field(i).Tag.Get("agi")
+		if key == "" || key == "-" {
+			continue
+		}
+		value, ok := a.Env[key]
+		if !ok {
+			continue
+		}
+		field := rv.Field(i)
+		if !field.CanSet() {
+			return fmt.Errorf("cannot set unexported field %s", rt.Field(i).Name)
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid agi_%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// setField converts value to the kind of field and stores it.
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// MarshalLog returns a JSON-serializable record of the session for structured logging,
+// holding a copy of the AGI environment and the session stats.
+func (a *Session) MarshalLog() map[string]interface{} {
+	env := make(map[string]string, len(a.Env))
+	for k, v := range a.Env {
+		env[k] = v
+	}
+	return map[string]interface{}{
+		"env":             env,
+		"command_count":   a.CommandCount(),
+		"elapsed_time":    a.ElapsedTime().String(),
+		"hangup_received": a.hungUp(),
+	}
+}
+
+// LoadEnvFromJSON creates a new Session with its Env loaded from a JSON object, either an
+// environment dump mapping variable names to values or a record returned by MarshalLog.
+// The agi_ prefix of variable names is optional. The session is not connected to asterisk,
+// AGI commands fail until it is initialized.
+func LoadEnvFromJSON(data []byte) (*Session, error) {
+	var rec struct {
+		Env map[string]string `json:"env"`
+	}
+	var env map[string]string
+	if err := json.Unmarshal(data, &rec); err == nil && rec.Env != nil {
+		env = rec.Env
+	} else if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	a := New()
+	for k, v := range env {
+		a.Env[strings.TrimPrefix(k, "agi_")] = v
+	}
+	return a, nil
+}
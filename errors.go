@@ -0,0 +1,163 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AGI protocol errors.
+var (
+	ErrHangupResponse = errors.New("HANGUP")                                  // Asterisk sent a HANGUP request.
+	Err510Response    = errors.New("invalid or unknown command")              // 510 response.
+	Err511Response    = errors.New("command not permitted on a dead channel") // 511 response.
+	Err520Response    = errors.New("invalid command syntax")                  // 520 response.
+)
+
+// HangupError is returned when Asterisk sends a HANGUP request. It carries the unique ID and channel
+// of the session that was hung up and matches ErrHangupResponse with errors.Is.
+type HangupError struct {
+	SessionID string
+	Channel   string
+}
+
+func (e HangupError) Error() string {
+	return ErrHangupResponse.Error()
+}
+
+// Is reports whether target is ErrHangupResponse or a HangupError.
+func (e HangupError) Is(target error) bool {
+	if target == ErrHangupResponse {
+		return true
+	}
+	_, ok := target.(HangupError)
+	return ok
+}
+
+// hangupError returns a HangupError for the session.
+func (a *Session) hangupError() error {
+	return HangupError{SessionID: a.Env["uniqueid"], Channel: a.Env["channel"]}
+}
+
+// DeadChannelError is returned when Asterisk replies with 511, as the channel is dead and no further
+// commands are permitted. It carries the channel name and matches Err511Response with errors.Is.
+type DeadChannelError struct {
+	Channel string
+}
+
+func (e DeadChannelError) Error() string {
+	if e.Channel == "" {
+		return Err511Response.Error()
+	}
+	return Err511Response.Error() + ": " + e.Channel
+}
+
+// Is reports whether target is Err511Response or a DeadChannelError.
+func (e DeadChannelError) Is(target error) bool {
+	if target == Err511Response {
+		return true
+	}
+	_, ok := target.(DeadChannelError)
+	return ok
+}
+
+// IsHangup reports whether err, as returned along with a Reply, is caused by a HANGUP request.
+func IsHangup(err error) bool {
+	return errors.Is(err, ErrHangupResponse)
+}
+
+// ErrMalformed200Response is returned when a 200 AGI response doesn't have the expected format.
+// Msg holds the offending part of the response. It matches any other ErrMalformed200Response
+// with errors.Is, regardless of the message.
+type ErrMalformed200Response struct {
+	Msg string
+}
+
+func (e ErrMalformed200Response) Error() string {
+	return "malformed 200 response: " + e.Msg
+}
+
+// Is reports whether target is an ErrMalformed200Response.
+func (e ErrMalformed200Response) Is(target error) bool {
+	_, ok := target.(ErrMalformed200Response)
+	return ok
+}
+
+// ErrMalformedAGIResponse is returned when a malformed, partial or unexpected AGI response is received.
+// Msg holds the response line. It matches any other ErrMalformedAGIResponse with errors.Is,
+// regardless of the message.
+type ErrMalformedAGIResponse struct {
+	Msg string
+}
+
+func (e ErrMalformedAGIResponse) Error() string {
+	return "malformed or partial agi response: " + e.Msg
+}
+
+// Is reports whether target is an ErrMalformedAGIResponse.
+func (e ErrMalformedAGIResponse) Is(target error) bool {
+	_, ok := target.(ErrMalformedAGIResponse)
+	return ok
+}
+
+// ErrFailedToParse200Response is returned when the numeric result of a 200 AGI response
+// can't be parsed. Err holds the underlying parsing error.
+type ErrFailedToParse200Response struct {
+	Err error
+}
+
+func (e ErrFailedToParse200Response) Error() string {
+	return fmt.Sprintf("failed to parse AGI 200 reply: %v", e.Err)
+}
+
+// Unwrap returns the underlying parsing error.
+func (e ErrFailedToParse200Response) Unwrap() error {
+	return e.Err
+}
+
+// ErrVariableNotSet is returned by typed variable getters like GetVariableInt when the channel
+// variable is not set. It matches any other ErrVariableNotSet with errors.Is, regardless of the name.
+type ErrVariableNotSet struct {
+	Name string
+}
+
+func (e ErrVariableNotSet) Error() string {
+	return "variable not set: " + e.Name
+}
+
+// Is reports whether target is an ErrVariableNotSet.
+func (e ErrVariableNotSet) Is(target error) bool {
+	_, ok := target.(ErrVariableNotSet)
+	return ok
+}
+
+// ErrInvalidCommand is returned, without sending the command, when an AGI command contains control
+// characters that could confuse the asterisk AGI parser. Pos holds the byte offset of the first
+// offending character and Byte its value. It matches any other ErrInvalidCommand with errors.Is.
+type ErrInvalidCommand struct {
+	Pos  int
+	Byte byte
+}
+
+func (e ErrInvalidCommand) Error() string {
+	return fmt.Sprintf("invalid control character 0x%02x at position %d of agi command", e.Byte, e.Pos)
+}
+
+// Is reports whether target is an ErrInvalidCommand.
+func (e ErrInvalidCommand) Is(target error) bool {
+	_, ok := target.(ErrInvalidCommand)
+	return ok
+}
+
+// isProtocolError reports whether err is an AGI protocol error, as opposed to an I/O error.
+func isProtocolError(err error) bool {
+	var perr ErrFailedToParse200Response
+	return errors.Is(err, ErrHangupResponse) || errors.Is(err, Err510Response) ||
+		errors.Is(err, Err511Response) || errors.Is(err, Err520Response) ||
+		errors.Is(err, ErrMalformed200Response{}) || errors.Is(err, ErrMalformedAGIResponse{}) ||
+		errors.As(err, &perr)
+}
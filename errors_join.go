@@ -0,0 +1,15 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+//go:build go1.20
+
+package agi
+
+import "errors"
+
+// joinErrors returns an error wrapping errs, nil if errs is empty.
+func joinErrors(errs []error) error {
+	return errors.Join(errs...)
+}
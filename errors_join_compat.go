@@ -0,0 +1,36 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+//go:build !go1.20
+// +build !go1.20
+
+package agi
+
+import "strings"
+
+// joinErrors returns an error wrapping errs, nil if errs is empty. It mirrors errors.Join of Go 1.20.
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return joinError(errs)
+}
+
+// joinError is the error returned by joinErrors, its message holds the messages of all
+// the errors separated by newlines.
+type joinError []error
+
+func (e joinError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the joined errors.
+func (e joinError) Unwrap() []error {
+	return e
+}
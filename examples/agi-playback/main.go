@@ -52,7 +52,7 @@ func main() {
 		log.Fatalf("AGI reply error: %v\n", err)
 	}
 	// Answer channel if not already answered.
-	if rep.Res != 6 {
+	if rep.ChannelState() != agi.ChannelUp {
 		rep, err = myAgi.Answer()
 		if err != nil || rep.Res == -1 {
 			log.Fatalf("Failed to answer channel: %v\n", err)
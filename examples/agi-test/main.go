@@ -15,7 +15,6 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"log"
 	"net"
@@ -78,8 +77,7 @@ func spawnAgi(c net.Conn) {
 	var err error
 	if c != nil {
 		// Create a new FastAGI session.
-		rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
-		err = myAgi.Init(rw)
+		err = myAgi.InitConn(c)
 		defer c.Close()
 	} else {
 		// Create a new AGI session.
@@ -113,7 +111,7 @@ func testAgi(sess *agi.Session) {
 
 	sess.Verbose("Testing channelstatus...")
 	r, err = sess.ChannelStatus()
-	if err != nil || r.Res != 6 {
+	if err != nil || r.ChannelState() != agi.ChannelUp {
 		sess.Verbose("Failed.")
 	} else {
 		pass++
@@ -184,7 +182,7 @@ func testAgi(sess *agi.Session) {
 	tests++
 
 	sess.Verbose("Testing saynumber...")
-	r, err = sess.SayNumber(192837465, "")
+	r, err = sess.SayNumberLarge(192837465, "")
 	if err != nil || r.Res != 0 {
 		sess.Verbose("Failed.")
 	} else {
@@ -238,7 +236,7 @@ func testAgi(sess *agi.Session) {
 	tests++
 
 	sess.Verbose("Testing get full variable...")
-	r, err = sess.GetFullVariable("${testagi}")
+	r, err = sess.GetFullVariableExpr("testagi")
 	if err != nil || r.Res != 1 || r.Dat != "foo" {
 		sess.Verbose("Failed.")
 	} else {
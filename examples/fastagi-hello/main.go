@@ -8,9 +8,7 @@
 package main
 
 import (
-	"bufio"
 	"log"
-	"net"
 
 	"github.com/zaf/agi"
 )
@@ -18,34 +16,17 @@ import (
 const debug = false
 
 func main() {
-	// Create a listener on port 4573 and start a new goroutine for each connection.
-	ln, err := net.Listen("tcp", ":4573")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer ln.Close()
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		go connHandle(conn)
-	}
+	// Listen on port 4573, the server handles each new FastAGI session in its own goroutine.
+	srv := &agi.Server{Addr: ":4573", Handler: agi.HandlerFunc(agiHandle)}
+	log.Fatal(srv.ListenAndServe())
 }
 
-func connHandle(c net.Conn) {
+func agiHandle(myAgi *agi.Session) {
 	defer func() {
-		c.Close()
 		if err := recover(); err != nil {
 			log.Println("Session terminated:", err)
 		}
 	}()
-	// Create a new FastAGI session and Parse the AGI environment.
-	myAgi := agi.New()
-	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
-	err := myAgi.Init(rw)
-	checkErr(err)
 	if debug {
 		// Print to stderr all AGI environment variables that are stored in myAgi.Env map.
 		log.Println("AGI environment vars:")
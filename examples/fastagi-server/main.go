@@ -12,7 +12,7 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"flag"
 	"log"
 	"net"
@@ -81,8 +81,7 @@ func agiConnHandle(client net.Conn, wg *sync.WaitGroup) {
 	}()
 	// Create a new AGI session
 	myAgi := agi.New()
-	rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
-	err := myAgi.Init(rw)
+	err := myAgi.InitConn(client)
 	checkErr(err)
 	var file string
 	var rep agi.Reply
@@ -106,7 +105,7 @@ func agiConnHandle(client net.Conn, wg *sync.WaitGroup) {
 	rep, err = myAgi.ChannelStatus()
 	checkErr(err)
 	// Answer channel if not already answered
-	if rep.Res != 6 {
+	if rep.ChannelState() != agi.ChannelUp {
 		rep, err = myAgi.Answer()
 		checkErr(err)
 		if rep.Res == -1 {
@@ -135,7 +134,7 @@ func parseAgiReq(request string) (string, url.Values) {
 //Check for AGI Protocol errors or hangups
 func checkErr(e error) {
 	if e != nil {
-		if e.Error() == "HANGUP" {
+		if errors.Is(e, agi.ErrHangupResponse) {
 			panic("Client Hangup")
 		}
 		panic("AGI error: " + e.Error())
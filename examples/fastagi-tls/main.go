@@ -8,10 +8,8 @@
 package main
 
 import (
-	"bufio"
 	"crypto/tls"
 	"log"
-	"net"
 
 	"github.com/zaf/agi"
 )
@@ -24,39 +22,21 @@ const (
 )
 
 func main() {
-	// Create a TLS listener on port 4574 and start a new goroutine for each connection.
-	tlsCert, err := tls.LoadX509KeyPair(cert, key)
-	if err != nil {
-		log.Fatal(err)
-	}
-	tlsConf := tls.Config{Certificates: []tls.Certificate{tlsCert}, MinVersion: tls.VersionTLS10}
-	tlsLn, err := tls.Listen("tcp", listen, &tlsConf)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer tlsLn.Close()
-	for {
-		conn, err := tlsLn.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		go connHandle(conn)
+	// Create a TLS server on port 4574, each new FastAGI session is handled in its own goroutine.
+	srv := &agi.Server{
+		Addr:      listen,
+		Handler:   agi.HandlerFunc(agiHandle),
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS10},
 	}
+	log.Fatal(srv.ListenAndServeTLS(cert, key))
 }
 
-func connHandle(c net.Conn) {
+func agiHandle(myAgi *agi.Session) {
 	defer func() {
-		c.Close()
 		if err := recover(); err != nil {
 			log.Println("Session terminated:", err)
 		}
 	}()
-	// Create a new FastAGI session and Parse the AGI environment.
-	myAgi := agi.New()
-	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
-	err := myAgi.Init(rw)
-	checkErr(err)
 	if debug {
 		// Print to stderr all AGI environment variables that are stored in myAgi.Env map.
 		log.Println("AGI environment vars:")
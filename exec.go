@@ -0,0 +1,59 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import "fmt"
+
+// ExecResult is the Reply of an Exec command, Res holds the return value of the dialplan application.
+type ExecResult Reply
+
+// IsAppNotFound reports whether the application executed by Exec was not found.
+func (r ExecResult) IsAppNotFound() bool {
+	return r.Res == -2
+}
+
+// AppResultParsers maps dialplan application names to functions that decode the Reply of
+// Exec for that application, as the meaning of the return value is application specific.
+// Packages can register parsers for additional applications, the map is not safe for
+// concurrent modification and is meant to be populated during initialization.
+//
+// The built-in parsers return:
+//
+//	Playback, WaitExten: bool, true if the application completed successfully.
+//	Background: string, the digit pressed or empty if playback completed.
+//
+// There is no AGIReturn application, the value passed to Return by a GoSub routine is read
+// with GoSubReturnValue instead.
+var AppResultParsers = map[string]func(Reply) interface{}{
+	"Playback":   parseSuccess,
+	"WaitExten":  parseSuccess,
+	"Background": parseDigit,
+}
+
+// ParseExecResult decodes the Reply of executing app with Exec using the parser registered
+// in AppResultParsers. It returns an error if the application was not found. Replies of
+// applications without a registered parser are returned as an ExecResult.
+func ParseExecResult(app string, r Reply) (interface{}, error) {
+	if ExecResult(r).IsAppNotFound() {
+		return nil, fmt.Errorf("application not found: %s", app)
+	}
+	parse, ok := AppResultParsers[app]
+	if !ok {
+		return ExecResult(r), nil
+	}
+	return parse(r), nil
+}
+
+func parseSuccess(r Reply) interface{} {
+	return r.Res == 0
+}
+
+func parseDigit(r Reply) interface{} {
+	if r.Res <= 0 {
+		return ""
+	}
+	return string(rune(r.Res))
+}
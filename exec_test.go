@@ -0,0 +1,39 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import "testing"
+
+// Test decoding of Exec replies
+func TestParseExecResult(t *testing.T) {
+	tests := []struct {
+		app      string
+		r        Reply
+		expected interface{}
+	}{
+		{"Playback", Reply{Res: 0}, true},
+		{"Playback", Reply{Res: -1}, false},
+		{"WaitExten", Reply{Res: 0}, true},
+		{"Background", Reply{Res: 0}, ""},
+		{"Background", Reply{Res: '5'}, "5"},
+		{"Dial", Reply{Res: 0, Dat: "bar"}, ExecResult{Res: 0, Dat: "bar"}},
+	}
+	for _, tc := range tests {
+		res, err := ParseExecResult(tc.app, tc.r)
+		if err != nil {
+			t.Errorf("Failed to parse %s result: %v", tc.app, err)
+		}
+		if res != tc.expected {
+			t.Errorf("Error parsing %s result %v. Expecting: %#v, got: %#v", tc.app, tc.r, tc.expected, res)
+		}
+	}
+	if _, err := ParseExecResult("Foo", Reply{Res: -2}); err == nil {
+		t.Error("ParseExecResult failed to detect missing application")
+	}
+	if !(ExecResult{Res: -2}).IsAppNotFound() || (ExecResult{Res: -1}).IsAppNotFound() {
+		t.Error("Error detecting missing application")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+//go:build go1.18
+// +build go1.18
+
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func FuzzParseEnv(f *testing.F) {
+	f.Add(env)
+	f.Add(envInv)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		a := New()
+		a.buf = bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(data)), bufio.NewWriter(ioutil.Discard))
+		err := a.parseEnv()
+		if err != nil && a.Env != nil {
+			t.Errorf("Env not cleared after error %v: %v", err, a.Env)
+		}
+		if err == nil && len(a.Env) < envMin {
+			t.Errorf("Incomplete environment accepted: %v", a.Env)
+		}
+	})
+}
+
+func FuzzParseResponse(f *testing.F) {
+	for _, fixture := range [][]byte{rep, repInv, repVal, repMulti} {
+		for _, line := range bytes.SplitAfter(fixture, []byte("\n")) {
+			f.Add(line)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		a := New()
+		a.buf = bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(data)), bufio.NewWriter(ioutil.Discard))
+		r, err := a.parseResponse()
+		if err == nil && !bytes.HasPrefix(data, []byte("200")) {
+			t.Errorf("Reply %+v accepted from non 200 response: %q", r, data)
+		}
+	})
+}
@@ -1,3 +1,5 @@
 module github.com/zaf/agi
 
 go 1.17
+
+require golang.org/x/sys v0.11.0
@@ -0,0 +1,116 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SetVariables sets multiple channel variables, one SetVariable command per variable in
+// alphabetical order. It stops at the first error and returns the replies received so far.
+func (a *Session) SetVariables(vars map[string]interface{}) ([]Reply, error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	replies := make([]Reply, 0, len(vars))
+	for _, name := range names {
+		r, err := a.SetVariable(name, vars[name])
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, r)
+	}
+	return replies, nil
+}
+
+// SetVariablesOrdered sets multiple channel variables given as alternating name/value pairs,
+// preserving their order. Names must be strings. It stops at the first error and returns the
+// replies received so far.
+func (a *Session) SetVariablesOrdered(pairs ...interface{}) ([]Reply, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of arguments: %d", len(pairs))
+	}
+	replies := make([]Reply, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		name, ok := pairs[i].(string)
+		if !ok {
+			return replies, fmt.Errorf("variable name is not a string: %v", pairs[i])
+		}
+		r, err := a.SetVariable(name, pairs[i+1])
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, r)
+	}
+	return replies, nil
+}
+
+// GetVariables gets the values of multiple channel variables, one GetVariable command per name.
+// Variables that are not set map to an empty string. It stops at the first error.
+func (a *Session) GetVariables(names ...string) (map[string]string, error) {
+	return a.getVariables(a.GetVariable, names)
+}
+
+// GetFullVariables evaluates multiple channel expressions, one GetFullVariable command per name.
+// Expressions that evaluate to nothing map to an empty string. It stops at the first error.
+func (a *Session) GetFullVariables(names ...string) (map[string]string, error) {
+	return a.getVariables(func(name string) (Reply, error) { return a.GetFullVariable(name) }, names)
+}
+
+func (a *Session) getVariables(get func(string) (Reply, error), names []string) (map[string]string, error) {
+	vars := make(map[string]string, len(names))
+	for _, name := range names {
+		r, err := get(name)
+		if err != nil {
+			return vars, err
+		}
+		vars[name] = r.Dat
+	}
+	return vars, nil
+}
+
+// DatabaseGetTree gets all the key/value pairs of the database family, or of the keytree
+// under it when given. Keys are relative to the family or keytree, an empty map is returned
+// if there are no keys. There is no AGI command for this, it is a wrapper that evaluates
+// ${DB_KEYS()} and then ${DB()} for every key with GetFullVariable, taking N+1 round-trips.
+func (a *Session) DatabaseGetTree(family string, keytree ...string) (map[string]string, error) {
+	if keytree != nil && keytree[0] != "" {
+		family += "/" + keytree[0]
+	}
+	tree := make(map[string]string)
+	r, err := a.GetFullVariable("${DB_KEYS(" + family + ")}")
+	if err != nil || r.Dat == "" {
+		return tree, err
+	}
+	for _, key := range strings.Split(r.Dat, ",") {
+		r, err = a.GetFullVariable("${DB(" + family + "/" + key + ")}")
+		if err != nil {
+			return tree, err
+		}
+		tree[key] = r.Dat
+	}
+	return tree, nil
+}
+
+// ChannelStatusAll returns the state of each of the given channels. It sends one ChannelStatus
+// command per channel, as AGI has no bulk channel status command, so it takes N round-trips.
+// Channels that don't exist are reported with state -1. It stops at the first error and
+// returns the states received so far.
+func (a *Session) ChannelStatusAll(channels ...string) (map[string]ChannelState, error) {
+	states := make(map[string]ChannelState, len(channels))
+	for _, channel := range channels {
+		r, err := a.ChannelStatus(channel)
+		if err != nil {
+			return states, err
+		}
+		states[channel] = r.ChannelState()
+	}
+	return states, nil
+}
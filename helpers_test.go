@@ -0,0 +1,115 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"errors"
+	"testing"
+)
+
+// Test retrieval of database trees
+func TestDatabaseGetTree(t *testing.T) {
+	f := newFakeAsterisk("200 result=1 (foo,bar)", "200 result=1 (1)", "200 result=1 (2)")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	tree, err := a.DatabaseGetTree("cidname", "sub")
+	if err != nil {
+		t.Fatalf("Failed to get database tree: %v", err)
+	}
+	if len(tree) != 2 || tree["foo"] != "1" || tree["bar"] != "2" {
+		t.Errorf("Error getting database tree: %v", tree)
+	}
+	want := "GET FULL VARIABLE \"${DB_KEYS(cidname/sub)}\"\n" +
+		"GET FULL VARIABLE \"${DB(cidname/sub/foo)}\"\n" +
+		"GET FULL VARIABLE \"${DB(cidname/sub/bar)}\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+
+	f = newFakeAsterisk("200 result=0")
+	a = New()
+	a.Init(f.rw())
+	if tree, err = a.DatabaseGetTree("empty"); err != nil || tree == nil || len(tree) != 0 {
+		t.Errorf("Expecting an empty tree, got: %v %v", tree, err)
+	}
+}
+
+// Test retrieval of multiple channel states
+func TestChannelStatusAll(t *testing.T) {
+	f := newFakeAsterisk("200 result=6", "200 result=-1", "510 Invalid or unknown command")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	states, err := a.ChannelStatusAll("SIP/1", "SIP/2")
+	if err != nil {
+		t.Fatalf("Failed to get channel states: %v", err)
+	}
+	if len(states) != 2 || states["SIP/1"] != ChannelUp || states["SIP/2"] != -1 {
+		t.Errorf("Error getting channel states: %v", states)
+	}
+	want := "CHANNEL STATUS \"SIP/1\"\nCHANNEL STATUS \"SIP/2\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+	if states, err = a.ChannelStatusAll("SIP/3", "SIP/4"); err == nil || len(states) != 0 {
+		t.Errorf("Expecting an error and no states, got: %v %v", states, err)
+	}
+}
+
+// Test bulk setting of channel variables
+func TestSetVariables(t *testing.T) {
+	f := newFakeAsterisk("200 result=1", "200 result=1", "200 result=1", "510 Invalid or unknown command", "200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	replies, err := a.SetVariables(map[string]interface{}{"b": "x y", "a": 1})
+	if err != nil || len(replies) != 2 || replies[0].Res != 1 || replies[1].Res != 1 {
+		t.Errorf("Failed to set variables: %v %v", replies, err)
+	}
+	want := "SET VARIABLE \"a\" \"1\"\nSET VARIABLE \"b\" \"x y\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+	f.out.Reset()
+	replies, err = a.SetVariables(map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	if !errors.Is(err, Err510Response) || len(replies) != 1 || replies[0].Res != 1 {
+		t.Errorf("Expecting 510 error after 1 reply, got: %v %v", replies, err)
+	}
+	want = "SET VARIABLE \"a\" \"1\"\nSET VARIABLE \"b\" \"2\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
+
+// Test bulk retrieval of channel variables
+func TestGetVariables(t *testing.T) {
+	f := newFakeAsterisk("200 result=1 (foo)", "200 result=0", "200 result=1 (1)", "510 Invalid or unknown command", "200 result=1 (2)")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	vars, err := a.GetVariables("a", "b")
+	if err != nil || len(vars) != 2 || vars["a"] != "foo" || vars["b"] != "" {
+		t.Errorf("Failed to get variables: %v %v", vars, err)
+	}
+	want := "GET VARIABLE \"a\"\nGET VARIABLE \"b\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+	f.out.Reset()
+	vars, err = a.GetFullVariables("${a}", "${b}", "${c}")
+	if !errors.Is(err, Err510Response) || len(vars) != 1 || vars["${a}"] != "1" {
+		t.Errorf("Expecting 510 error after 1 variable, got: %v %v", vars, err)
+	}
+	want = "GET FULL VARIABLE \"${a}\"\nGET FULL VARIABLE \"${b}\"\n"
+	if f.out.String() != want {
+		t.Errorf("Unexpected commands: %q", f.out.String())
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import "time"
+
+// CommandRecord is an AGI command sent by a Session along with its outcome, as returned by CommandHistory.
+type CommandRecord struct {
+	Cmd   string    // AGI command line, without the trailing newline.
+	Reply Reply     // Parsed reply.
+	Err   error     // Error returned by the command, if any.
+	At    time.Time // Time the command was sent.
+}
+
+// commandHistory is a fixed capacity ring buffer of command records.
+type commandHistory struct {
+	recs []CommandRecord
+	next int // Index of the next record to be written.
+	n    int // Number of records stored.
+}
+
+func newCommandHistory(capacity int) *commandHistory {
+	return &commandHistory{recs: make([]CommandRecord, capacity)}
+}
+
+// add stores rec, overwriting the oldest record when full.
+func (h *commandHistory) add(rec CommandRecord) {
+	h.recs[h.next] = rec
+	h.next = (h.next + 1) % len(h.recs)
+	if h.n < len(h.recs) {
+		h.n++
+	}
+}
+
+// last returns up to n of the most recent records, oldest first.
+func (h *commandHistory) last(n int) []CommandRecord {
+	if n <= 0 || n > h.n {
+		n = h.n
+	}
+	recs := make([]CommandRecord, n)
+	start := h.next - n + len(h.recs)
+	for i := range recs {
+		recs[i] = h.recs[(start+i)%len(h.recs)]
+	}
+	return recs
+}
+
+// CommandHistory returns up to the last n AGI commands sent by the session and their outcome,
+// oldest first. If n is zero or less all the recorded commands are returned. Commands are only
+// recorded when the history is enabled with WithHistoryCapacity.
+func (a *Session) CommandHistory(n int) []CommandRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.history == nil {
+		return nil
+	}
+	return a.history.last(n)
+}
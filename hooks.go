@@ -0,0 +1,31 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+// Hooks holds optional functions called on session events, to observe the AGI traffic of a
+// Session without wrapping it. OnCommand and OnResponse are called synchronously by the
+// goroutine sending the command, without holding the session lock. They may call methods of
+// the Session like CommandCount, but must not send AGI commands. OnHangup is called in its
+// own goroutine.
+type Hooks struct {
+	OnCommand  func(cmd string)         // Called with each AGI command before it is sent.
+	OnResponse func(r Reply, err error) // Called with the parsed reply, or the error, of each AGI command.
+	OnHangup   func()                   // Called the first time a HANGUP request is detected.
+}
+
+// SetHooks sets the event hooks of the session, replacing any previously set.
+func (a *Session) SetHooks(h Hooks) {
+	a.mu.Lock()
+	a.hooks = h
+	a.mu.Unlock()
+}
+
+// getHooks returns the event hooks of the session.
+func (a *Session) getHooks() Hooks {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.hooks
+}
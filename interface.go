@@ -0,0 +1,104 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import "time"
+
+// SessionInterface is the set of AGI command methods of Session. Application code that accepts
+// a SessionInterface instead of a *Session can be unit tested with a mock implementation,
+// like the one provided by the agitest package. Every method of Session returning a (Reply, error)
+// pair is part of SessionInterface.
+type SessionInterface interface {
+	Answer() (Reply, error)
+	AsyncagiBreak() (Reply, error)
+	ChannelStatus(channel ...string) (Reply, error)
+	ControlStreamFile(file, escape string, params ...interface{}) (Reply, error)
+	ControlStreamFileWithOptions(file, escape string, opts ControlStreamOptions) (Reply, error)
+	DatabaseDel(family, key string) (Reply, error)
+	DatabaseDelTree(family string, keytree ...string) (Reply, error)
+	DatabaseGet(family, key string) (Reply, error)
+	DatabasePut(family, key, value string) (Reply, error)
+	DisableAutohangup() (Reply, error)
+	Exec(app, options string) (Reply, error)
+	Failure() (Reply, error)
+	GetData(file string, params ...int) (Reply, error)
+	GetDataDuration(file string, timeout time.Duration, maxdigits ...int) (Reply, error)
+	GetFullVariable(variable string, channel ...string) (Reply, error)
+	GetFullVariableExpr(name string, channel ...string) (Reply, error)
+	GetOption(filename, escape string, timeout ...int) (Reply, error)
+	GetOptionDigits(filename string, escape DigitSet, timeout ...int) (Reply, error)
+	GetOptionNoTimeout(filename, escape string) (Reply, error)
+	GetOptionWithTimeout(filename, escape string, timeout time.Duration) (Reply, error)
+	GetVariable(variable string) (Reply, error)
+	GoSub(context, extension, priority, args string) (Reply, error)
+	GoSubNoArgs(context, extension, priority string) (Reply, error)
+	Hangup(channel ...string) (Reply, error)
+	Noop(params ...interface{}) (Reply, error)
+	RawCommand(params ...interface{}) (Reply, error)
+	ReceiveChar(timeout int) (Reply, error)
+	ReceiveCharDuration(d time.Duration) (Reply, error)
+	ReceiveText(timeout int) (Reply, error)
+	RecordFile(file, format, escape string, timeout int, params ...interface{}) (Reply, error)
+	RecordFileDuration(file, format, escape string, timeout time.Duration, params ...interface{}) (Reply, error)
+	RecordFileWithOptions(file, format, escape string, timeout int, opts RecordFileOptions) (Reply, error)
+	SayAlpha(str, escape string) (Reply, error)
+	SayAlphaBytes(data []byte, escape string) (Reply, error)
+	SayAlphaFiltered(str, escape string, filter func(rune) bool) (Reply, error)
+	SayCharacter(c rune, escape string) (Reply, error)
+	SayDate(date int64, escape string) (Reply, error)
+	SayDatetime(t time.Time, escape string, params ...string) (Reply, error)
+	SayDateTime(datetime int64, escape string, params ...string) (Reply, error)
+	SayDateTimeWithOptions(datetime int64, escape string, opts SayDateTimeOptions) (Reply, error)
+	SayDateValue(t time.Time, escape string) (Reply, error)
+	SayDigits(digit int, escape string) (Reply, error)
+	SayNumber(num int, escape string, gender ...string) (Reply, error)
+	SayNumberFloat(amount float64, escape string, locale ...string) (Reply, error)
+	SayNumberLarge(num int64, escape string, gender ...string) (Reply, error)
+	SayPhonetic(str, escape string) (Reply, error)
+	SaySpelling(word, escape string) (Reply, error)
+	SayTime(t int64, escape string) (Reply, error)
+	SayTimeValue(t time.Time, escape string) (Reply, error)
+	SendImage(image string) (Reply, error)
+	SendText(text string) (Reply, error)
+	SendTextSafe(text string, maxLen int) (Reply, error)
+	SetAutohangup(seconds int) (Reply, error)
+	SetAutohangupDuration(d time.Duration) (Reply, error)
+	SetCallerid(cid string) (Reply, error)
+	SetCallerIDParsed(name, number string) (Reply, error)
+	SetContext(context string) (Reply, error)
+	SetExtension(ext string) (Reply, error)
+	SetExtensionInt(ext int) (Reply, error)
+	SetMusic(opt string, class ...string) (Reply, error)
+	SetMusicOff() (Reply, error)
+	SetMusicOn(class ...string) (Reply, error)
+	SetPriority(priority string) (Reply, error)
+	SetTddMode(mode TddModeValue) (Reply, error)
+	SetVariable(variable string, value interface{}) (Reply, error)
+	SetVariableBool(variable string, value bool) (Reply, error)
+	SetVariableFloat(variable string, value float64, prec int) (Reply, error)
+	SetVariableInt(variable string, value int64) (Reply, error)
+	SpeechActivateGrammar(grammar string) (Reply, error)
+	SpeechCreate(engine string) (Reply, error)
+	SpeechDeactivateGrammar(grammar string) (Reply, error)
+	SpeechDestroy() (Reply, error)
+	SpeechLoadGrammar(grammar, path string) (Reply, error)
+	SpeechLoadGrammarInline(name, grammarContent string) (Reply, error)
+	SpeechRecognize(prompt, timeout, offset string) (Reply, error)
+	SpeechSet(name, value string) (Reply, error)
+	SpeechUnloadGrammar(grammar string) (Reply, error)
+	StreamFile(file, escape string, offset ...int) (Reply, error)
+	StreamFileDigits(file string, escape DigitSet, offset ...int) (Reply, error)
+	StreamFileList(files []string, escape string) (Reply, error)
+	TddMode(mode string) (Reply, error)
+	Verbose(msg interface{}, level ...int) (Reply, error)
+	Verbosef(format string, args ...interface{}) (Reply, error)
+	Verbosef2(level int, format string, args ...interface{}) (Reply, error)
+	WaitForDigit(timeout int) (Reply, error)
+	WaitForDigitBlock() (Reply, error)
+	WaitForDigitDuration(d time.Duration) (Reply, error)
+}
+
+var _ SessionInterface = (*Session)(nil)
@@ -0,0 +1,28 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Test that SessionInterface includes all the AGI command methods of Session
+func TestSessionInterface(t *testing.T) {
+	iface := reflect.TypeOf((*SessionInterface)(nil)).Elem()
+	replyType := reflect.TypeOf(Reply{})
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	st := reflect.TypeOf(&Session{})
+	for i := 0; i < st.NumMethod(); i++ {
+		m := st.Method(i)
+		if m.Type.NumOut() != 2 || m.Type.Out(0) != replyType || m.Type.Out(1) != errorType {
+			continue
+		}
+		if _, ok := iface.MethodByName(m.Name); !ok {
+			t.Errorf("Session method %s is missing from SessionInterface", m.Name)
+		}
+	}
+}
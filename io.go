@@ -0,0 +1,155 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// ctxReader is an io.Reader that refuses to read once its context is done.
+// A read still blocked when the context gets done is abandoned and fails with the context error.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if c.ctx.Done() == nil {
+		return c.r.Read(p)
+	}
+	res := make(chan readResult, 1)
+	go func(buf []byte) {
+		n, err := c.r.Read(buf)
+		res <- readResult{buf[:n], err}
+	}(make([]byte, len(p)))
+	select {
+	case r := <-res:
+		return copy(p, r.p), r.err
+	case <-c.ctx.Done():
+		return 0, c.ctx.Err()
+	}
+}
+
+// ctxWriter is an io.Writer that refuses to write once its context is done.
+// If the wrapped writer is buffered it gets flushed after every write.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c ctxWriter) Write(p []byte) (int, error) {
+	select {
+	case <-c.ctx.Done():
+		return 0, c.ctx.Err()
+	default:
+	}
+	n, err := c.w.Write(p)
+	if f, ok := c.w.(flusher); ok && err == nil {
+		err = f.Flush()
+	}
+	return n, err
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// traceRW echoes all data read from and written to a session to a trace writer.
+type traceRW struct {
+	rw *bufio.ReadWriter
+	w  io.Writer
+}
+
+func (t *traceRW) Read(p []byte) (int, error) {
+	n, err := t.rw.Read(p)
+	if t.w != nil && n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t *traceRW) Write(p []byte) (int, error) {
+	n, err := t.rw.Write(p)
+	if err == nil {
+		err = t.rw.Flush()
+	}
+	if t.w != nil && n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// deadlineRW enforces a deadline on an io.ReadWriter that doesn't support deadlines natively.
+// A blocked read is abandoned when the deadline expires and its result is delivered on the next read.
+type deadlineRW struct {
+	rw       io.ReadWriter
+	deadline time.Time
+	pending  chan readResult
+	rest     readResult
+}
+
+type readResult struct {
+	p   []byte
+	err error
+}
+
+func (d *deadlineRW) Read(p []byte) (int, error) {
+	if len(d.rest.p) > 0 || d.rest.err != nil {
+		n := copy(p, d.rest.p)
+		d.rest.p = d.rest.p[n:]
+		if len(d.rest.p) > 0 {
+			return n, nil
+		}
+		err := d.rest.err
+		d.rest.err = nil
+		return n, err
+	}
+	if d.pending == nil {
+		if d.deadline.IsZero() {
+			return d.rw.Read(p)
+		}
+		d.pending = make(chan readResult, 1)
+		go func(buf []byte, ch chan<- readResult) {
+			n, err := d.rw.Read(buf)
+			ch <- readResult{buf[:n], err}
+		}(make([]byte, len(p)), d.pending)
+	}
+	var timeout <-chan time.Time
+	if !d.deadline.IsZero() {
+		wait := time.Until(d.deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case d.rest = <-d.pending:
+		d.pending = nil
+		return d.Read(p)
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (d *deadlineRW) Write(p []byte) (int, error) {
+	if !d.deadline.IsZero() && !time.Now().Before(d.deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := d.rw.Write(p)
+	if f, ok := d.rw.(flusher); ok && err == nil {
+		err = f.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,244 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// StreamFileList plays back a list of audio files in sequence, allowing the listener to interrupt
+// the whole sequence by pressing one of the escape digits. Playback stops at the first file with a
+// non zero Res, that is a digit was pressed or playback failed, and its Reply is returned.
+// Otherwise the Reply of the last file is returned. Errors are wrapped along with the index of the
+// file that caused them.
+func (a *Session) StreamFileList(files []string, escape string) (Reply, error) {
+	var r Reply
+	var err error
+	for i, file := range files {
+		r, err = a.StreamFile(file, escape)
+		if err != nil {
+			return r, fmt.Errorf("failed to stream file %d (%s): %w", i, file, err)
+		}
+		if r.Res != 0 {
+			break
+		}
+	}
+	return r, nil
+}
+
+// SayNumberFloat says a currency amount like 3.50 as "three dollars fifty cents", rounded to
+// cents. It says the integer part followed by the stock "dollars" prompt, or "letters/dollar" for
+// one dollar, and, unless zero, the cents followed by "cents", or "cent" for one cent, stopping at
+// the first non zero Res, that is a digit was pressed or playback failed. The optional locale sets
+// the channel language while the amount is said, the session language (agi_language) is restored
+// afterwards, and the currency prompts are played from the locale directory, like "de/dollars".
+func (a *Session) SayNumberFloat(amount float64, escape string, locale ...string) (Reply, error) {
+	if amount < 0 || math.IsNaN(amount) || math.IsInf(amount, 0) || amount >= math.MaxInt64/100 {
+		return Reply{}, fmt.Errorf("invalid amount: %v", amount)
+	}
+	var dir string
+	if locale != nil {
+		if _, err := a.SetVariable("CHANNEL(language)", locale[0]); err != nil {
+			return Reply{}, err
+		}
+		defer a.SetVariable("CHANNEL(language)", a.Env["language"])
+		dir = locale[0] + "/"
+	}
+	total := int64(math.Round(amount * 100))
+	dollars, cents := total/100, total%100
+	r, err := a.SayNumberLarge(dollars, escape)
+	if err != nil || r.Res != 0 {
+		return r, err
+	}
+	prompt := "dollars"
+	if dollars == 1 {
+		prompt = "letters/dollar"
+	}
+	r, err = a.StreamFile(dir+prompt, escape)
+	if err != nil || r.Res != 0 || cents == 0 {
+		return r, err
+	}
+	r, err = a.SayNumberLarge(cents, escape)
+	if err != nil || r.Res != 0 {
+		return r, err
+	}
+	prompt = "cents"
+	if cents == 1 {
+		prompt = "cent"
+	}
+	return a.StreamFile(dir+prompt, escape)
+}
+
+// SaySpelling spells out word, saying runs of letters with SayPhonetic, runs of digits with
+// SAY DIGITS, keeping any leading zeros, and anything else with SayAlpha. It stops at the first
+// non zero Res, that is a digit was pressed or playback failed, and returns its Reply.
+func (a *Session) SaySpelling(word, escape string) (Reply, error) {
+	var r Reply
+	var err error
+	for word != "" {
+		kind := charKind(rune(word[0]))
+		i := 1
+		for i < len(word) && charKind(rune(word[i])) == kind {
+			i++
+		}
+		switch kind {
+		case 'a':
+			r, err = a.SayPhonetic(word[:i], escape)
+		case 'd':
+			r, err = a.sendMsg(fmt.Sprintf("SAY DIGITS %q %q", word[:i], escape))
+		default:
+			r, err = a.SayAlpha(word[:i], escape)
+		}
+		if err != nil || r.Res != 0 {
+			return r, err
+		}
+		word = word[i:]
+	}
+	return r, nil
+}
+
+// charKind classifies c as a letter ('a'), a digit ('d') or anything else (0).
+func charKind(c rune) byte {
+	switch {
+	case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		return 'a'
+	case c >= '0' && c <= '9':
+		return 'd'
+	}
+	return 0
+}
+
+// CollectDigits collects up to maxDigits DTMF digits using WaitForDigit. It waits up to
+// firstDigitTimeout for the first digit and up to interDigitTimeout between subsequent digits.
+// A negative timeout blocks indefinitely. It returns early once maxDigits are collected, or
+// with the digits collected so far when a timeout elapses. Channel failures are reported as errors,
+// along with any digits already collected. Nothing is collected if maxDigits is not positive.
+func (a *Session) CollectDigits(maxDigits int, firstDigitTimeout, interDigitTimeout time.Duration) (string, error) {
+	res, err := a.CollectDigitsDetailed(maxDigits, firstDigitTimeout, interDigitTimeout, "")
+	return res.Digits, err
+}
+
+// CollectDigitsResult holds the outcome of CollectDigitsDetailed.
+type CollectDigitsResult struct {
+	Digits     string // Digits collected, without the terminating escape digit.
+	Timeout    bool   // Collection ended because a timeout elapsed before maxDigits were collected.
+	Terminated bool   // Collection ended because an escape digit was pressed.
+}
+
+// CollectDigitsDetailed collects DTMF digits like CollectDigits, additionally ending the collection
+// when one of the escape digits is pressed. The result reports how the collection ended, so that
+// pressing nothing (Timeout with no Digits) can be told apart from pressing an escape digit right
+// away (Terminated with no Digits).
+func (a *Session) CollectDigitsDetailed(maxDigits int, firstDigitTimeout, interDigitTimeout time.Duration, escape string) (CollectDigitsResult, error) {
+	var res CollectDigitsResult
+	if maxDigits <= 0 {
+		return res, nil
+	}
+	digits := make([]byte, 0, maxDigits)
+	timeout := firstDigitTimeout
+	for len(digits) < maxDigits {
+		r, err := a.WaitForDigit(millis(timeout))
+		if err != nil {
+			res.Digits = string(digits)
+			return res, err
+		}
+		if r.Res < 0 {
+			res.Digits = string(digits)
+			return res, errors.New("channel failure while waiting for digit")
+		}
+		if r.Res == 0 {
+			res.Timeout = true
+			break
+		}
+		if strings.IndexByte(escape, byte(r.Res)) >= 0 {
+			res.Terminated = true
+			break
+		}
+		digits = append(digits, byte(r.Res))
+		timeout = interDigitTimeout
+	}
+	res.Digits = string(digits)
+	return res, nil
+}
+
+// PromptAndCollect plays back promptFile and collects up to maxDigits DTMF digits. A digit pressed
+// during the prompt interrupts the playback and is kept as the first collected digit, then
+// CollectDigits gathers the rest waiting up to timeout for each one. escape holds the digits that
+// interrupt the prompt, if empty all DTMF digits (0-9, * and #) do. If maxDigits is not positive
+// the prompt is played back but no digits are returned.
+func (a *Session) PromptAndCollect(promptFile string, maxDigits int, timeout time.Duration, escape string) (string, error) {
+	if escape == "" {
+		escape = "0123456789*#"
+	}
+	r, err := a.StreamFile(promptFile, escape)
+	if err != nil {
+		return "", err
+	}
+	if r.Res < 0 {
+		return "", fmt.Errorf("failed to play back prompt %s", promptFile)
+	}
+	if r.Res == 0 || maxDigits <= 0 {
+		return a.CollectDigits(maxDigits, timeout, timeout)
+	}
+	digits := string(rune(r.Res))
+	if maxDigits <= 1 {
+		return digits, nil
+	}
+	rest, err := a.CollectDigits(maxDigits-1, timeout, timeout)
+	return digits + rest, err
+}
+
+// ConfirmInput plays back promptFile and collects up to maxDigits DTMF digits like PromptAndCollect,
+// then says the collected digits followed by confirmFile and waits up to timeout for one of the
+// confirmEscape or rejectEscape digits. Both the digit playback and confirmFile can be interrupted
+// by those digits. The interaction is repeated, up to maxAttempts times in total, until a
+// confirmEscape digit is pressed. Attempts with no digits collected, a rejectEscape or other digit
+// pressed, or no digit pressed in time are retried. If maxAttempts is not positive a single attempt
+// is made. confirmed is true only if the input was confirmed, digits holds the last input collected.
+func (a *Session) ConfirmInput(promptFile, confirmFile string, maxDigits int, timeout time.Duration, confirmEscape, rejectEscape string, maxAttempts int) (digits string, confirmed bool, err error) {
+	for i := 0; i == 0 || i < maxAttempts; i++ {
+		digits, confirmed, err = a.confirmInput(promptFile, confirmFile, maxDigits, timeout, confirmEscape, rejectEscape)
+		if err != nil || confirmed {
+			break
+		}
+	}
+	return digits, confirmed, err
+}
+
+// confirmInput makes a single ConfirmInput attempt.
+func (a *Session) confirmInput(promptFile, confirmFile string, maxDigits int, timeout time.Duration, confirmEscape, rejectEscape string) (string, bool, error) {
+	digits, err := a.PromptAndCollect(promptFile, maxDigits, timeout, "")
+	if err != nil || digits == "" {
+		return digits, false, err
+	}
+	escape := confirmEscape + rejectEscape
+	r, err := a.sendMsg(fmt.Sprintf("SAY DIGITS %q %q", digits, escape))
+	if err == nil && r.Res == 0 {
+		r, err = a.StreamFile(confirmFile, escape)
+	}
+	if err == nil && r.Res == 0 {
+		r, err = a.WaitForDigit(millis(timeout))
+	}
+	if err != nil {
+		return digits, false, err
+	}
+	if r.Res < 0 {
+		return digits, false, errors.New("channel failure while waiting for confirmation")
+	}
+	return digits, r.Res > 0 && strings.ContainsRune(confirmEscape, rune(r.Res)), nil
+}
+
+// millis converts d to milliseconds for AGI timeout parameters, negative durations map to -1.
+func millis(d time.Duration) int {
+	if d < 0 {
+		return -1
+	}
+	return int(d / time.Millisecond)
+}
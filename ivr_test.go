@@ -0,0 +1,280 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test playback of a list of files with barge-in
+func TestStreamFileList(t *testing.T) {
+	f := newFakeAsterisk("200 result=0 endpos=100", "200 result=50 endpos=20",
+		"200 result=0 endpos=100", "200 result=0 endpos=200", "510 Invalid or unknown command")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	r, err := a.StreamFileList([]string{"a", "b", "c"}, "12")
+	if err != nil || r.Res != '2' || r.Dat != "20" {
+		t.Errorf("Expecting playback interrupted by digit 2, got: %+v %v", r, err)
+	}
+	cmds := "STREAM FILE \"a\" \"12\"\nSTREAM FILE \"b\" \"12\"\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+	f.out.Reset()
+	r, err = a.StreamFileList([]string{"a", "b"}, "12")
+	if err != nil || r.Res != 0 || r.Dat != "200" {
+		t.Errorf("Expecting the reply of the last file, got: %+v %v", r, err)
+	}
+	cmds = "STREAM FILE \"a\" \"12\"\nSTREAM FILE \"b\" \"12\"\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+	f.out.Reset()
+	_, err = a.StreamFileList([]string{"a", "b"}, "12")
+	if !errors.Is(err, Err510Response) || !strings.Contains(err.Error(), "file 0 (a)") {
+		t.Errorf("Expecting wrapped 510 error for file 0, got: %v", err)
+	}
+	if f.out.String() != "STREAM FILE \"a\" \"12\"\n" {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
+
+// Test currency amount playback
+func TestSayNumberFloat(t *testing.T) {
+	f := newFakeAsterisk("200 result=1", "200 result=0", "200 result=0 endpos=1234",
+		"200 result=0", "200 result=0 endpos=1234", "200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	r, err := a.SayNumberFloat(3.499, "#", "de")
+	if err != nil {
+		t.Fatalf("Failed to say amount: %v", err)
+	}
+	if r.Res != 0 {
+		t.Errorf("Expecting Res: 0, got: %d", r.Res)
+	}
+	cmds := "SET VARIABLE \"CHANNEL(language)\" \"de\"\n" +
+		"SAY NUMBER \"3\" \"#\"\nSTREAM FILE \"de/dollars\" \"#\"\n" +
+		"SAY NUMBER \"50\" \"#\"\nSTREAM FILE \"de/cents\" \"#\"\n" +
+		"SET VARIABLE \"CHANNEL(language)\" \"en\"\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+	if _, err = a.SayNumberFloat(-1, ""); err == nil {
+		t.Error("Expecting an error for a negative amount")
+	}
+}
+
+// Test singular currency prompts
+func TestSayNumberFloatSingular(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0 endpos=1234", "200 result=0", "200 result=0 endpos=1234")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if _, err := a.SayNumberFloat(1.01, ""); err != nil {
+		t.Fatalf("Failed to say amount: %v", err)
+	}
+	cmds := "SAY NUMBER \"1\" \"\"\nSTREAM FILE \"letters/dollar\" \"\"\n" +
+		"SAY NUMBER \"1\" \"\"\nSTREAM FILE \"cent\" \"\"\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
+
+// Test spelling of mixed content strings
+func TestSaySpelling(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0", "200 result=0", "200 result=0", "200 result=35")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	r, err := a.SaySpelling("AB007-x", "#")
+	if err != nil {
+		t.Fatalf("Failed to spell word: %v", err)
+	}
+	if r.Res != 0 {
+		t.Errorf("Expecting Res: 0, got: %d", r.Res)
+	}
+	cmds := "SAY PHONETIC \"AB\" \"#\"\nSAY DIGITS \"007\" \"#\"\n" +
+		"SAY ALPHA \"-\" \"#\"\nSAY PHONETIC \"x\" \"#\"\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+	f.out.Reset()
+	r, err = a.SayCharacter('z', "#")
+	if err != nil || r.Res != '#' {
+		t.Errorf("Unexpected SayCharacter reply: %v, %v", r, err)
+	}
+	if f.out.String() != "SAY ALPHA \"z\" \"#\"\n" {
+		t.Errorf("Unexpected AGI command sent: %q", f.out.String())
+	}
+}
+
+// Test DTMF collection
+func TestCollectDigits(t *testing.T) {
+	f := newFakeAsterisk("200 result=49", "200 result=50", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	digits, err := a.CollectDigits(4, 5*time.Second, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to collect digits: %v", err)
+	}
+	if digits != "12" {
+		t.Errorf("Expecting digits: 12, got: %s", digits)
+	}
+	cmds := "WAIT FOR DIGIT 5000\nWAIT FOR DIGIT 2000\nWAIT FOR DIGIT 2000\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
+
+// Test DTMF collection with termination details
+func TestCollectDigitsDetailed(t *testing.T) {
+	f := newFakeAsterisk("200 result=49", "200 result=35", "200 result=35", "200 result=0", "200 result=50", "200 result=51")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	tests := []CollectDigitsResult{
+		{Digits: "1", Terminated: true},
+		{Digits: "", Terminated: true},
+		{Digits: "", Timeout: true},
+		{Digits: "23"},
+	}
+	for _, want := range tests {
+		res, err := a.CollectDigitsDetailed(2, time.Second, time.Second, "#")
+		if err != nil {
+			t.Fatalf("Failed to collect digits: %v", err)
+		}
+		if res != want {
+			t.Errorf("Expecting result: %+v, got: %+v", want, res)
+		}
+	}
+}
+
+// Test prompt playback with barge-in and DTMF collection
+func TestPromptAndCollect(t *testing.T) {
+	f := newFakeAsterisk("200 result=55 endpos=1234", "200 result=56", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	digits, err := a.PromptAndCollect("enter-pin", 4, time.Second, "")
+	if err != nil {
+		t.Fatalf("Failed to collect digits: %v", err)
+	}
+	if digits != "78" {
+		t.Errorf("Expecting digits: 78, got: %s", digits)
+	}
+	cmds := "STREAM FILE \"enter-pin\" \"0123456789*#\"\nWAIT FOR DIGIT 1000\nWAIT FOR DIGIT 1000\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
+
+// Test DTMF collection with no digits requested
+func TestCollectDigitsNone(t *testing.T) {
+	f := newFakeAsterisk("200 result=55 endpos=1234")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	for _, max := range []int{0, -1} {
+		res, err := a.CollectDigitsDetailed(max, time.Second, time.Second, "#")
+		if err != nil {
+			t.Fatalf("Failed to collect digits: %v", err)
+		}
+		if res != (CollectDigitsResult{}) {
+			t.Errorf("Expecting empty result for %d digits, got: %+v", max, res)
+		}
+	}
+	digits, err := a.PromptAndCollect("enter-pin", 0, time.Second, "")
+	if err != nil {
+		t.Fatalf("Failed to collect digits: %v", err)
+	}
+	if digits != "" {
+		t.Errorf("Expecting no digits, got: %s", digits)
+	}
+	cmds := "STREAM FILE \"enter-pin\" \"0123456789*#\"\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
+
+// Test input collection with confirmation
+func TestConfirmInput(t *testing.T) {
+	f := newFakeAsterisk("200 result=0 endpos=1234", "200 result=52", "200 result=50", "200 result=0",
+		"200 result=0", "200 result=0 endpos=1234", "200 result=49")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	digits, confirmed, err := a.ConfirmInput("enter-pin", "press-1-or-2", 4, time.Second, "1", "2", 3)
+	if err != nil {
+		t.Fatalf("Failed to confirm input: %v", err)
+	}
+	if digits != "42" || !confirmed {
+		t.Errorf("Expecting confirmed digits: 42, got: %s %v", digits, confirmed)
+	}
+	cmds := "STREAM FILE \"enter-pin\" \"0123456789*#\"\nWAIT FOR DIGIT 1000\nWAIT FOR DIGIT 1000\n" +
+		"WAIT FOR DIGIT 1000\nSAY DIGITS \"42\" \"12\"\nSTREAM FILE \"press-1-or-2\" \"12\"\nWAIT FOR DIGIT 1000\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
+
+// Test input confirmation retries
+func TestConfirmInputRetry(t *testing.T) {
+	f := newFakeAsterisk("200 result=55", "200 result=0", "200 result=50",
+		"200 result=56", "200 result=0", "200 result=0 endpos=1234", "200 result=0",
+		"200 result=57", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	digits, confirmed, err := a.ConfirmInput("enter-pin", "press-1-or-2", 4, time.Second, "1", "2", 2)
+	if err != nil {
+		t.Fatalf("Failed to confirm input: %v", err)
+	}
+	if digits != "8" || confirmed {
+		t.Errorf("Expecting unconfirmed digits: 8, got: %s %v", digits, confirmed)
+	}
+	cmds := "STREAM FILE \"enter-pin\" \"0123456789*#\"\nWAIT FOR DIGIT 1000\nSAY DIGITS \"7\" \"12\"\n" +
+		"STREAM FILE \"enter-pin\" \"0123456789*#\"\nWAIT FOR DIGIT 1000\nSAY DIGITS \"8\" \"12\"\n" +
+		"STREAM FILE \"press-1-or-2\" \"12\"\nWAIT FOR DIGIT 1000\n"
+	if f.out.String() != cmds {
+		t.Errorf("Unexpected AGI commands sent: %q", f.out.String())
+	}
+}
+
+// Test typed GetData results
+func TestGetDataTyped(t *testing.T) {
+	f := newFakeAsterisk("200 result=0800", "200 result= (timeout)", "200 result=-1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	res, err := a.GetDataTyped("enter-number", 5000, 4)
+	if err != nil || res.Digits != "0800" || res.Timeout {
+		t.Errorf("Error parsing GetData result. Expecting: 0800, got: %+v %v", res, err)
+	}
+	res, err = a.GetDataTyped("enter-number", 5000, 4)
+	if err != nil || res.Digits != "" || !res.Timeout {
+		t.Errorf("Error parsing GetData timeout. Got: %+v %v", res, err)
+	}
+	if _, err = a.GetDataTyped("enter-number", 5000, 4); err == nil {
+		t.Error("No error after GetData failure")
+	}
+}
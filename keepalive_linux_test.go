@@ -0,0 +1,69 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+//go:build linux
+// +build linux
+
+package agi
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Test TCP keep-alive settings of accepted connections
+func TestKeepAliveListener(t *testing.T) {
+	_, defIdle := acceptKeepAlive(t, 0, false)
+	tests := []struct {
+		period    time.Duration
+		keepAlive bool
+		idle      int
+	}{
+		{0, false, defIdle},
+		{-1, false, defIdle},
+		{42 * time.Second, true, 42},
+	}
+	for _, test := range tests {
+		keepAlive, idle := acceptKeepAlive(t, test.period, true)
+		if keepAlive != test.keepAlive || keepAlive && idle != test.idle {
+			t.Errorf("Unexpected keep-alive settings for %v: SO_KEEPALIVE=%v TCP_KEEPIDLE=%d", test.period, keepAlive, idle)
+		}
+	}
+}
+
+// acceptKeepAlive accepts a TCP connection, through keepAliveListener if wrap is set,
+// and returns its SO_KEEPALIVE and TCP_KEEPIDLE socket options.
+func acceptKeepAlive(t *testing.T, period time.Duration, wrap bool) (bool, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	defer ln.Close()
+	l := ln
+	if wrap {
+		l = keepAliveListener{ln, period}
+	}
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer c.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept connection: %v", err)
+	}
+	defer c.Close()
+	rc, _ := c.(*net.TCPConn).SyscallConn()
+	var keepAlive, idle int
+	rc.Control(func(fd uintptr) {
+		keepAlive, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		idle, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+	})
+	return keepAlive != 0, idle
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"strings"
+	"time"
+)
+
+// Metrics collects measurements of a FastAGI Server and its sessions.
+// The metrics sub-package provides a Prometheus implementation.
+type Metrics interface {
+	SessionStarted()                                  // A new session was accepted.
+	SessionEnded()                                    // A session ended.
+	CommandCompleted(command string, d time.Duration) // An AGI command got its reply after d.
+	HangupReceived()                                  // A HANGUP request was received.
+	SessionTimedOut()                                 // A session failed a health check and was closed.
+}
+
+// commandName returns the name of an AGI command, the leading upper case words of the command line.
+func commandName(cmd string) string {
+	fields := strings.Fields(cmd)
+	n := 0
+	for n < len(fields) && strings.IndexFunc(fields[n], notUpper) < 0 {
+		n++
+	}
+	return strings.Join(fields[:n], " ")
+}
+
+func notUpper(r rune) bool {
+	return r < 'A' || r > 'Z'
+}
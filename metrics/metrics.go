@@ -0,0 +1,102 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+/*
+Package metrics implements Prometheus instrumentation for FastAGI servers. It is a separate
+module so that applications not interested in metrics don't depend on the Prometheus client.
+For example, to export the metrics of a FastAGI server:
+
+	srv := &agi.Server{Handler: handler}
+	srv.Metrics = metrics.New(prometheus.DefaultRegisterer)
+	log.Fatal(srv.ListenAndServe())
+
+The following metrics are collected:
+
+	agi_sessions_total               Total number of FastAGI sessions.
+	agi_sessions_active              Number of active FastAGI sessions.
+	agi_command_duration_seconds     Duration of AGI commands, labeled by command name.
+	agi_hangups_total                Total number of HANGUP requests received.
+	agi_sessions_timed_out_total     Total number of sessions closed after failing a health check.
+*/
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zaf/agi"
+)
+
+var _ agi.Metrics = (*Prometheus)(nil)
+
+// Prometheus is an agi.Metrics implementation backed by Prometheus collectors.
+type Prometheus struct {
+	sessions prometheus.Counter
+	active   prometheus.Gauge
+	commands *prometheus.HistogramVec
+	hangups  prometheus.Counter
+	timedOut prometheus.Counter
+}
+
+// New creates the Prometheus collectors and registers them with r. It panics if
+// the registration fails, like prometheus.MustRegister.
+func New(r prometheus.Registerer) *Prometheus {
+	p := &Prometheus{
+		sessions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "agi",
+			Name:      "sessions_total",
+			Help:      "Total number of FastAGI sessions.",
+		}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "agi",
+			Name:      "sessions_active",
+			Help:      "Number of active FastAGI sessions.",
+		}),
+		commands: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "agi",
+			Name:      "command_duration_seconds",
+			Help:      "Duration of AGI commands.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"command"}),
+		hangups: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "agi",
+			Name:      "hangups_total",
+			Help:      "Total number of HANGUP requests received.",
+		}),
+		timedOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "agi",
+			Name:      "sessions_timed_out_total",
+			Help:      "Total number of sessions closed after failing a health check.",
+		}),
+	}
+	r.MustRegister(p.sessions, p.active, p.commands, p.hangups, p.timedOut)
+	return p
+}
+
+// SessionStarted counts a new session.
+func (p *Prometheus) SessionStarted() {
+	p.sessions.Inc()
+	p.active.Inc()
+}
+
+// SessionEnded marks the end of a session.
+func (p *Prometheus) SessionEnded() {
+	p.active.Dec()
+}
+
+// CommandCompleted observes the duration of an AGI command.
+func (p *Prometheus) CommandCompleted(command string, d time.Duration) {
+	p.commands.WithLabelValues(command).Observe(d.Seconds())
+}
+
+// HangupReceived counts a HANGUP request.
+func (p *Prometheus) HangupReceived() {
+	p.hangups.Inc()
+}
+
+// SessionTimedOut counts a session closed after failing a health check.
+func (p *Prometheus) SessionTimedOut() {
+	p.timedOut.Inc()
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a HandlerFunc, adding behaviour before and after it handles a session.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// Chain composes middlewares left to right into a single Middleware, so that
+// Chain(m1, m2)(h) is equivalent to m1(m2(h)) and m1 is the outermost wrapper.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return h
+	}
+}
+
+// LoggingMiddleware logs the start and end of every session, along with its duration,
+// using the log package's standard logger.
+func LoggingMiddleware(next HandlerFunc) HandlerFunc {
+	return func(s *Session) {
+		start := time.Now()
+		log.Printf("agi: session %s started, script: %q", s.Env["uniqueid"], s.Env["network_script"])
+		defer func() {
+			log.Printf("agi: session %s ended after %v", s.Env["uniqueid"], time.Since(start))
+		}()
+		next(s)
+	}
+}
+
+// RecoveryMiddleware recovers from panics in the wrapped handler. The panic and its stack trace
+// are logged at error level with the session logger, or the log package's standard logger if the
+// session has none, and then the channel is hung up.
+func RecoveryMiddleware(next HandlerFunc) HandlerFunc {
+	return RecoveryMiddlewareWithHandler(logPanic)(next)
+}
+
+// RecoveryMiddlewareWithHandler recovers from panics in the wrapped handler like RecoveryMiddleware,
+// calling h with the session and the recovered value instead of logging them. The stack trace of
+// the panic is available to h through runtime/debug.Stack. The channel is hung up after h returns.
+func RecoveryMiddlewareWithHandler(h func(s *Session, err interface{})) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Session) {
+			defer func() {
+				if err := recover(); err != nil {
+					h(s, err)
+					safeHangup(s)
+				}
+			}()
+			next(s)
+		}
+	}
+}
+
+// logPanic logs a recovered panic along with the stack trace.
+func logPanic(s *Session, err interface{}) {
+	stack := string(debug.Stack())
+	if s.logger != nil {
+		s.logger.Error("agi: panic in session", "session_id", s.Env["uniqueid"], "panic", err, "stack", stack)
+		return
+	}
+	log.Printf("agi: panic in session %s: %v\n%s", s.Env["uniqueid"], err, stack)
+}
+
+// safeHangup hangs up the channel, ignoring any errors or panics.
+func safeHangup(s *Session) {
+	defer func() {
+		recover()
+	}()
+	s.Hangup()
+}
+
+// TimeoutMiddleware limits the duration of every session to d. Once d elapses any pending
+// or further AGI commands fail with an error wrapping os.ErrDeadlineExceeded, see SetDeadline.
+func TimeoutMiddleware(d time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Session) {
+			if err := s.SetDeadline(time.Now().Add(d)); err != nil {
+				log.Printf("agi: failed to set deadline of session %s: %v", s.Env["uniqueid"], err)
+			}
+			next(s)
+		}
+	}
+}
+
+// RateLimitMiddleware limits every session to sending at most maxCmdsPerSecond AGI commands per
+// second, delaying commands as needed. This throttles automated input, like rapid DTMF entry
+// collected with successive commands. If the session context is done while a command is delayed,
+// the command fails with an error wrapping the context error. A zero or negative rate means no limit.
+func RateLimitMiddleware(maxCmdsPerSecond float64) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Session) {
+			if maxCmdsPerSecond > 0 {
+				s.limiter = newRateLimiter(maxCmdsPerSecond)
+			}
+			next(s)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+//go:build go1.21
+
+package agi
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// RequestLoggerMiddleware logs one line at info level for every completed session, with the
+// session duration, whether it ended in a hangup and the given AGI environment variables.
+// Variables are named without the agi_ prefix and default to uniqueid, channel and request.
+func RequestLoggerMiddleware(logger *slog.Logger, fields ...string) Middleware {
+	if len(fields) == 0 {
+		fields = []string{"uniqueid", "channel", "request"}
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(s *Session) {
+			start := time.Now()
+			defer func() {
+				attrs := make([]slog.Attr, 0, len(fields)+2)
+				for _, f := range fields {
+					attrs = append(attrs, slog.String(f, s.Env[f]))
+				}
+				attrs = append(attrs,
+					slog.Duration("duration", time.Since(start)),
+					slog.Bool("hangup", s.hungUp()),
+				)
+				logger.LogAttrs(context.Background(), slog.LevelInfo, "agi session", attrs...)
+			}()
+			next(s)
+		}
+	}
+}
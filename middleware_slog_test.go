@@ -0,0 +1,35 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+//go:build go1.21
+
+package agi
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRequestLoggerMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, nil))
+	f := newFakeAsterisk("HANGUP")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	RequestLoggerMiddleware(logger, "channel", "context")(func(s *Session) { s.Answer() })(a)
+	line := out.String()
+	for _, want := range []string{"msg=\"agi session\"", "channel=SIP/1234-00000000", "context=default", "duration=", "hangup=true"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Log line missing %s: %s", want, line)
+		}
+	}
+	if strings.Contains(line, "uniqueid") {
+		t.Errorf("Log line has unexpected fields: %s", line)
+	}
+}
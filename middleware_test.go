@@ -0,0 +1,106 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(s *Session) {
+				order = append(order, name)
+				next(s)
+			}
+		}
+	}
+	Chain(mw("first"), mw("second"))(func(*Session) { order = append(order, "handler") })(New())
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "handler" {
+		t.Errorf("Wrong middleware order: %v", order)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	f := newFakeAsterisk("200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatal(err)
+	}
+	Chain(LoggingMiddleware, RecoveryMiddleware)(func(*Session) { panic("boom") })(a)
+	if !bytes.Equal(f.out.Bytes(), []byte("HANGUP\n")) {
+		t.Errorf("Expecting HANGUP after panic, got: %q", f.out.String())
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(env)
+	a := New()
+	err := a.Init(bufio.NewReadWriter(bufio.NewReader(pr), bufio.NewWriter(ioutil.Discard)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	TimeoutMiddleware(20 * time.Millisecond)(func(s *Session) {
+		_, err = s.Answer()
+	})(a)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expecting deadline error, got: %v", err)
+	}
+}
+
+func TestRecoveryMiddlewareWithHandler(t *testing.T) {
+	f := newFakeAsterisk("200 result=1")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatal(err)
+	}
+	var recovered interface{}
+	RecoveryMiddlewareWithHandler(func(s *Session, err interface{}) {
+		recovered = err
+	})(func(*Session) { panic("boom") })(a)
+	if recovered != "boom" {
+		t.Errorf("Unexpected recovered value: %v", recovered)
+	}
+	if f.out.String() != "HANGUP\n" {
+		t.Errorf("Expecting HANGUP after panic, got: %q", f.out.String())
+	}
+	// A panicking hangup must not escape the middleware.
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	RecoveryMiddleware(func(*Session) { panic("boom") })(new(Session))
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	f := newFakeAsterisk("200 result=0", "200 result=0", "200 result=0")
+	a := New()
+	if err := a.Init(f.rw()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	RateLimitMiddleware(50)(func(s *Session) {
+		for i := 0; i < 3; i++ {
+			if _, err := s.Answer(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})(a)
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("Commands were not rate limited, 3 commands took %v", d)
+	}
+}
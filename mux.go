@@ -0,0 +1,164 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mux is a FastAGI request multiplexer. It matches the script path of each session,
+// Env["network_script"], against a list of registered patterns and calls the handler
+// of the pattern that most closely matches it.
+//
+// Patterns name fixed script paths like "/playback" or rooted subtrees like "/ivr/".
+// A pattern ending in a slash matches all paths starting with it, longer patterns take
+// precedence over shorter ones. Leading slashes are optional and any query string is
+// ignored, so a request for agi://host/ivr/main?lang=en matches the pattern "/ivr/".
+type Mux struct {
+	// NotFound is called for sessions that match no pattern. If nil the session is ended.
+	NotFound HandlerFunc
+
+	mu       sync.RWMutex
+	exact    map[string]HandlerFunc
+	prefixes []muxEntry // Sorted from longest to shortest pattern.
+}
+
+type muxEntry struct {
+	pattern string
+	handler HandlerFunc
+}
+
+// DefaultMux is the default Mux used by Server when its Handler is nil.
+var DefaultMux = NewMux()
+
+// NewMux allocates and returns a new Mux.
+func NewMux() *Mux {
+	return &Mux{exact: make(map[string]HandlerFunc)}
+}
+
+// Handle registers the handler for the given pattern. It panics if the pattern is empty,
+// the handler is nil or a handler already exists for the pattern.
+func (m *Mux) Handle(pattern string, handler HandlerFunc) {
+	if pattern == "" {
+		panic("agi: invalid pattern")
+	}
+	if handler == nil {
+		panic("agi: nil handler")
+	}
+	pattern = cleanScript(pattern)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.exact == nil {
+		m.exact = make(map[string]HandlerFunc)
+	}
+	if !strings.HasSuffix(pattern, "/") {
+		if _, ok := m.exact[pattern]; ok {
+			panic("agi: multiple registrations for " + pattern)
+		}
+		m.exact[pattern] = handler
+		return
+	}
+	i := 0
+	for ; i < len(m.prefixes); i++ {
+		if m.prefixes[i].pattern == pattern {
+			panic("agi: multiple registrations for " + pattern)
+		}
+		if len(m.prefixes[i].pattern) < len(pattern) {
+			break
+		}
+	}
+	m.prefixes = append(m.prefixes, muxEntry{})
+	copy(m.prefixes[i+1:], m.prefixes[i:])
+	m.prefixes[i] = muxEntry{pattern, handler}
+}
+
+// Handler returns the handler to use for the given script path and the pattern that matched it.
+// If no pattern matches, a nil handler and an empty pattern are returned.
+func (m *Mux) Handler(script string) (HandlerFunc, string) {
+	script = cleanScript(script)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if h, ok := m.exact[script]; ok {
+		return h, script
+	}
+	for _, e := range m.prefixes {
+		if strings.HasPrefix(script, e.pattern) {
+			return e.handler, e.pattern
+		}
+	}
+	return nil, ""
+}
+
+// ServeAGI dispatches the session to the handler whose pattern most closely matches its script path.
+func (m *Mux) ServeAGI(s *Session) {
+	h, _ := m.Handler(s.Env["network_script"])
+	if h == nil {
+		h = m.NotFound
+	}
+	if h != nil {
+		h(s)
+	}
+}
+
+// RegexpMux is a FastAGI request multiplexer that matches the script path of each session,
+// Env["network_script"], against regular expressions. Patterns are tried in registration order
+// and the handler of the first one that matches is called. Like Mux, any query string is
+// stripped and the script path always starts with a slash before matching.
+type RegexpMux struct {
+	// NotFoundHandler is called for sessions that match no pattern. If nil the session is ended.
+	NotFoundHandler HandlerFunc
+
+	mu      sync.RWMutex
+	entries []regexpEntry
+}
+
+type regexpEntry struct {
+	pattern *regexp.Regexp
+	handler HandlerFunc
+}
+
+// HandleFunc registers the handler for the given pattern. It panics if the pattern or the handler is nil.
+func (m *RegexpMux) HandleFunc(pattern *regexp.Regexp, handler HandlerFunc) {
+	if pattern == nil {
+		panic("agi: nil pattern")
+	}
+	if handler == nil {
+		panic("agi: nil handler")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, regexpEntry{pattern, handler})
+}
+
+// ServeAGI dispatches the session to the handler of the first pattern that matches its script path.
+func (m *RegexpMux) ServeAGI(s *Session) {
+	script := cleanScript(s.Env["network_script"])
+	h := m.NotFoundHandler
+	m.mu.RLock()
+	for _, e := range m.entries {
+		if e.pattern.MatchString(script) {
+			h = e.handler
+			break
+		}
+	}
+	m.mu.RUnlock()
+	if h != nil {
+		h(s)
+	}
+}
+
+// cleanScript strips any query string from a script path and makes sure it starts with a slash.
+func cleanScript(script string) string {
+	if i := strings.IndexByte(script, '?'); i >= 0 {
+		script = script[:i]
+	}
+	if !strings.HasPrefix(script, "/") {
+		script = "/" + script
+	}
+	return script
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	var got string
+	handler := func(name string) HandlerFunc {
+		return func(*Session) { got = name }
+	}
+	m := NewMux()
+	m.Handle("/playback", handler("playback"))
+	m.Handle("ivr/", handler("ivr"))
+	m.Handle("/ivr/sales/", handler("sales"))
+	m.NotFound = handler("notfound")
+
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"playback", "playback"},
+		{"/playback?file=foo", "playback"},
+		{"playback/foo", "notfound"},
+		{"ivr/main", "ivr"},
+		{"/ivr/", "ivr"},
+		{"ivr/sales/queue?lang=en", "sales"},
+		{"ivr", "notfound"},
+		{"", "notfound"},
+	}
+	for _, tc := range tests {
+		got = ""
+		m.ServeAGI(&Session{Env: map[string]string{"network_script": tc.script}})
+		if got != tc.want {
+			t.Errorf("script %q: dispatched to %q, want %q", tc.script, got, tc.want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate pattern registration did not panic")
+		}
+	}()
+	m.Handle("/ivr/", handler("dup"))
+}
+
+func TestRegexpMux(t *testing.T) {
+	var got string
+	handler := func(name string) HandlerFunc {
+		return func(*Session) { got = name }
+	}
+	m := new(RegexpMux)
+	m.HandleFunc(regexp.MustCompile(`^/queue/\d+$`), handler("queue"))
+	m.HandleFunc(regexp.MustCompile(`^/queue/`), handler("queues"))
+	m.HandleFunc(regexp.MustCompile(`^/(play|record)$`), handler("media"))
+
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"/queue/42", "queue"},
+		{"queue/42?lang=en", "queue"},
+		{"/queue/sales", "queues"},
+		{"record", "media"},
+		{"/playback", ""},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		got = ""
+		m.ServeAGI(&Session{Env: map[string]string{"network_script": tc.script}})
+		if got != tc.want {
+			t.Errorf("script %q: dispatched to %q, want %q", tc.script, got, tc.want)
+		}
+	}
+	m.NotFoundHandler = handler("notfound")
+	m.ServeAGI(&Session{Env: map[string]string{"network_script": "/foo"}})
+	if got != "notfound" {
+		t.Errorf("script /foo: dispatched to %q, want notfound", got)
+	}
+}
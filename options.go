@@ -0,0 +1,64 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"io"
+	"time"
+)
+
+// Option configures a Session created by New.
+type Option func(*Session)
+
+// WithLogger sets the logger used for command-level tracing, see SetLogger.
+func WithLogger(l Logger) Option {
+	return func(a *Session) {
+		a.logger = l
+	}
+}
+
+// WithCommandTimeout sets the maximum time each AGI command may take, see SetCommandTimeout.
+func WithCommandTimeout(d time.Duration) Option {
+	return func(a *Session) {
+		a.cmdTimeout = d
+	}
+}
+
+// WithTraceWriter echoes the raw protocol data of the session to w, see Trace.
+func WithTraceWriter(w io.Writer) Option {
+	return func(a *Session) {
+		a.Trace(w)
+	}
+}
+
+// WithEnvCapacity sets the initial capacity of the Env map to n variables.
+func WithEnvCapacity(n int) Option {
+	return func(a *Session) {
+		a.Env = make(map[string]string, n)
+	}
+}
+
+// WithEnvMax sets the maximum number of AGI environment variables accepted by Init to n.
+func WithEnvMax(n int) Option {
+	return func(a *Session) {
+		a.EnvMax = n
+	}
+}
+
+// WithHangupCallback sets a function to be called the first time a HANGUP request from asterisk
+// is detected. It runs in its own goroutine.
+func WithHangupCallback(f func()) Option {
+	return func(a *Session) {
+		a.onHup = f
+	}
+}
+
+// WithHistoryCapacity enables recording of the last n AGI commands of the session, see CommandHistory.
+func WithHistoryCapacity(n int) Option {
+	return func(a *Session) {
+		a.histCap = n
+	}
+}
@@ -10,24 +10,42 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	envMin = 18  // Minimum number of AGI environment args
-	envMax = 150 // Maximum number of AGI environment args
+	envMax = 150 // Default maximum number of AGI environment args
+
+	hangupPollInterval = 100 * time.Millisecond // Interval of the HangupChan connection polling
+	hangupPollTimeout  = 10 * time.Millisecond  // Maximum duration of each HangupChan poll read
+
+	logCommandMax = 64 // Maximum length of invalid commands in debug logs
+
+	retryBaseDelay = 10 * time.Millisecond // Initial delay of WithRetry backoff
 )
 
 // parseEnv reads and stores AGI environment.
 func (a *Session) parseEnv() error {
 	var err error
 	var line []byte
-	for i := 0; i <= envMax; i++ {
+	limit := a.EnvMax
+	if limit <= 0 {
+		limit = envMax
+	}
+	for i := 0; ; i++ {
 		line, err = a.buf.ReadBytes(10)
 		if err != nil || len(line) <= len("\r\n") {
 			break
 		}
+		if i == limit {
+			err = fmt.Errorf("environment exceeds the maximum of %d env vars", limit)
+			break
+		}
 		// Strip trailing newline
 		line = line[:len(line)-1]
 		ind := bytes.IndexByte(line, ':')
@@ -42,22 +60,116 @@ func (a *Session) parseEnv() error {
 		value := string(line[ind:])
 		a.Env[key] = value
 	}
-	if len(a.Env) < envMin {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("timed out reading environment after %d env vars: %w", len(a.Env), err)
+	} else if len(a.Env) < envMin {
 		err = fmt.Errorf("incomplete environment with only %d env vars", len(a.Env))
+	}
+	if err != nil {
 		a.Env = nil
 	}
 	return err
 }
 
+// validateCommand checks that s contains no control characters other than tab, newline
+// and carriage return, which are replaced by spaces before sending.
+func validateCommand(s string) error {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			return ErrInvalidCommand{Pos: i, Byte: c}
+		}
+	}
+	return nil
+}
+
 // sendMsg sends an AGI command and returns the result.
 func (a *Session) sendMsg(s string) (Reply, error) {
-	// Make sure there wasn't any data received, usually a HANGUP request from asterisk.
-	if i := a.buf.Reader.Buffered(); i != 0 {
-		line, _ := a.buf.ReadBytes(10)
-		return Reply{}, fmt.Errorf(string(line[:len(line)-1]))
+	if err := validateCommand(s); err != nil {
+		if len(s) > logCommandMax {
+			s = s[:logCommandMax] + "..."
+		}
+		a.logDebug("invalid agi command", "command", s, "error", err)
+		return Reply{}, err
+	}
+	r, err := a.sendOnce(s, a.cmdTimeout)
+	delay := retryBaseDelay
+	for i := 0; i < a.retries && errors.Is(err, Err520Response); i++ {
+		if delay > a.retryBackoff {
+			delay = a.retryBackoff
+		}
+		if a.ctx != nil {
+			select {
+			case <-time.After(delay):
+			case <-a.ctx.Done():
+				return r, fmt.Errorf("command aborted: %w", a.ctx.Err())
+			}
+		} else {
+			time.Sleep(delay)
+		}
+		delay *= 2
+		r, err = a.sendOnce(s, a.cmdTimeout)
+	}
+	return r, err
+}
+
+// sendOnce sends an AGI command once, without retrying, waiting up to timeout for the reply
+// if it is positive, and returns the result.
+func (a *Session) sendOnce(s string, timeout time.Duration) (Reply, error) {
+	if a.pipe != nil {
+		s = strings.Replace(s, "\r", " ", -1)
+		s = strings.Replace(s, "\n", " ", -1)
+		*a.pipe = append(*a.pipe, s)
+		return Reply{}, nil
+	}
+	return a.send(s, timeout, true)
+}
+
+// send writes an AGI command and parses its reply. If track is false the command is sent
+// without the session bookkeeping: it is not rate limited, counted, recorded in the history,
+// passed to hooks or metrics, and it doesn't reset the idle timer, as used by health checks.
+func (a *Session) send(s string, timeout time.Duration, track bool) (r Reply, err error) {
+	if track && a.limiter != nil {
+		if err := a.limiter.wait(a.ctx); err != nil {
+			return Reply{}, fmt.Errorf("command aborted: %w", err)
+		}
 	}
 	s = strings.Replace(s, "\r", " ", -1)
 	s = strings.Replace(s, "\n", " ", -1)
+	if track {
+		// Hooks are called without holding the session lock, see Hooks.
+		h := a.getHooks()
+		if h.OnCommand != nil {
+			h.OnCommand(s)
+		}
+		if h.OnResponse != nil {
+			defer func() { h.OnResponse(r, err) }()
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.ready(); err != nil {
+		return Reply{}, err
+	}
+	if timeout > 0 {
+		if err := a.setIODeadline(earliest(time.Now().Add(timeout), a.deadline)); err != nil {
+			return Reply{}, err
+		}
+		defer a.setIODeadline(a.deadline)
+	}
+	a.logDebug("agi command", "command", s)
+	var done func(Reply, error)
+	if track {
+		done = a.beginCommand(s)
+	}
+	r, err = a.writeRead(s)
+	if done != nil {
+		done(r, err)
+	}
+	return r, err
+}
+
+// writeRead writes an AGI command and reads back its reply.
+func (a *Session) writeRead(s string) (Reply, error) {
 	if _, err := a.buf.WriteString(s + "\n"); err != nil {
 		return Reply{}, err
 	}
@@ -67,6 +179,56 @@ func (a *Session) sendMsg(s string) (Reply, error) {
 	return a.parseResponse()
 }
 
+// ready checks that commands can be sent: the session must be initialized, its context not done,
+// the channel not dead and no data received ahead of a command, usually a HANGUP request from
+// asterisk. a.mu must be held.
+func (a *Session) ready() error {
+	if a.buf == nil {
+		return fmt.Errorf("session not initialized")
+	}
+	if a.ctx != nil {
+		if err := a.ctx.Err(); err != nil {
+			return fmt.Errorf("command aborted: %w", err)
+		}
+	}
+	if atomic.LoadInt32(&a.dead) != 0 {
+		return DeadChannelError{a.Env["channel"]}
+	}
+	if i := a.buf.Reader.Buffered(); i != 0 {
+		line, _ := a.buf.ReadBytes(10)
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if bytes.Equal(line, []byte("HANGUP")) {
+			a.setHangup()
+			return a.hangupError()
+		}
+		return ErrMalformedAGIResponse{string(line)}
+	}
+	return nil
+}
+
+// beginCommand does the session bookkeeping of sending AGI command s and returns the function
+// that completes it once the reply is received: command counting, history, metrics and the
+// idle timer. a.mu must be held.
+func (a *Session) beginCommand(s string) func(Reply, error) {
+	start := time.Now()
+	if a.idleTimer != nil {
+		// The session isn't idle while a command is in progress.
+		a.idleTimer.Stop()
+	}
+	a.cmdCount++
+	return func(r Reply, err error) {
+		if a.metrics != nil {
+			a.metrics.CommandCompleted(commandName(s), time.Since(start))
+		}
+		if a.history != nil {
+			a.history.add(CommandRecord{Cmd: s, Reply: r, Err: err, At: start})
+		}
+		if a.idleTimer != nil && (err == nil || isProtocolError(err)) {
+			a.idleTimer.Reset(a.idleTimeout)
+		}
+	}
+}
+
 // parseResponse reads back and parses AGI response. Returns the Reply and the protocol error, if any.
 func (a *Session) parseResponse() (Reply, error) {
 	r := Reply{}
@@ -75,19 +237,33 @@ func (a *Session) parseResponse() (Reply, error) {
 		return r, err
 	}
 	// Strip trailing newline
-	line = line[:len(line)-1]
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	a.logDebug("agi reply", "reply", string(line))
+	// Multi-line 200 responses start with "200-", additional lines follow up to an empty line.
+	var extra []string
+	if bytes.HasPrefix(line, []byte("200-")) {
+		line[3] = ' '
+		extra, err = a.readMultiLine()
+		if err != nil {
+			return r, err
+		}
+	}
 	ind := bytes.IndexByte(line, ' ')
 	if ind <= 0 || ind == len(line)-1 {
 		// Line doesn't match /^\w+\s.+$/
 		if bytes.Equal(line, []byte("HANGUP")) {
-			err = errors.New("HANGUP")
+			a.setHangup()
+			err = a.hangupError()
 		} else {
-			err = fmt.Errorf("malformed or partial agi response: %s", string(line))
+			err = ErrMalformedAGIResponse{string(line)}
 		}
 		return r, err
 	}
 	switch string(line[:ind]) {
 	case "200":
+		if a.raw200 != nil {
+			*a.raw200 = string(line[ind+1:])
+		}
 		eqInd := bytes.IndexByte(line, '=')
 		if eqInd == len("200 result") && eqInd < len(line)-1 {
 			// If line matches /^200\s\w{7}=.*$/ strip the "200 result=" prefix.
@@ -97,32 +273,63 @@ func (a *Session) parseResponse() (Reply, error) {
 				// Line matches /^\w$/
 				r.Res, err = strconv.Atoi(string(line))
 				if err != nil {
-					err = fmt.Errorf("failed to parse AGI 200 reply: %v", err)
+					err = ErrFailedToParse200Response{err}
 				}
+				r.Dat = joinMultiLine(r.Dat, extra)
 				break
 			} else if spInd > 0 && spInd < len(line)-1 {
 				// Line matches /^\w+\s.+$/
 				r.Res, err = strconv.Atoi(string(line[:spInd]))
 				if err != nil {
-					err = fmt.Errorf("failed to parse AGI 200 reply: %v", err)
+					err = ErrFailedToParse200Response{err}
 				}
 				// Strip leading space and save additional returned data.
 				r.Dat = string(line[spInd+1:])
+				r.Dat = joinMultiLine(r.Dat, extra)
 				break
 			}
 		}
-		err = fmt.Errorf("malformed 200 response: %s", string(line))
+		err = ErrMalformed200Response{string(line)}
 	case "510":
-		err = errors.New("invalid or unknown command")
+		err = Err510Response
 	case "511":
-		err = errors.New("command not permitted on a dead channel")
+		atomic.StoreInt32(&a.dead, 1)
+		err = DeadChannelError{a.Env["channel"]}
 	case "520":
-		err = errors.New("invalid command syntax")
+		err = Err520Response
 	case "520-Invalid":
-		err = errors.New("invalid command syntax")
+		err = Err520Response
 		a.buf.ReadBytes(10) // Read Command syntax doc.
 	default:
-		err = fmt.Errorf("malformed or partial agi response: %s", string(line))
+		err = ErrMalformedAGIResponse{string(line)}
 	}
 	return r, err
 }
+
+// readMultiLine reads the additional lines of a multi-line response up to an empty line.
+func (a *Session) readMultiLine() ([]string, error) {
+	var lines []string
+	for {
+		line, err := a.buf.ReadString(10)
+		if err != nil {
+			return lines, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return lines, nil
+		}
+		a.logDebug("agi reply", "reply", line)
+		lines = append(lines, line)
+	}
+}
+
+// joinMultiLine appends the additional lines of a multi-line response to dat, newline separated.
+func joinMultiLine(dat string, extra []string) string {
+	if len(extra) == 0 {
+		return dat
+	}
+	if dat == "" {
+		return strings.Join(extra, "\n")
+	}
+	return dat + "\n" + strings.Join(extra, "\n")
+}
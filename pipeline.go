@@ -0,0 +1,87 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import "strings"
+
+// PipelineSession records AGI commands to be sent in a single write, saving the round-trip
+// latency of command bursts like Answer, SetVariable and StreamFile. Commands are recorded
+// by calling the usual Session methods, which return an empty Reply and a nil error, and
+// are sent when Execute is called. Only methods mapping to a single AGI command should be
+// used while recording.
+type PipelineSession struct {
+	*Session
+	parent *Session
+	cmds   []string
+}
+
+// Pipeline returns a new PipelineSession that records commands for a.
+func (a *Session) Pipeline() *PipelineSession {
+	p := &PipelineSession{Session: &Session{Env: a.Env}, parent: a}
+	p.Session.pipe = &p.cmds
+	return p
+}
+
+// Execute writes all recorded commands and then reads back their replies. The returned slices
+// hold the Reply and the error of each command in the order they were recorded. Replies are
+// returned as received, without any command specific post-processing of Dat.
+// The pipeline is emptied and can be reused.
+func (p *PipelineSession) Execute() ([]Reply, []error) {
+	a := p.parent
+	cmds := p.cmds
+	p.cmds = nil
+	replies := make([]Reply, len(cmds))
+	errs := make([]error, len(cmds))
+	if len(cmds) == 0 {
+		return replies, errs
+	}
+	h := a.getHooks()
+	if h.OnCommand != nil {
+		for _, cmd := range cmds {
+			h.OnCommand(cmd)
+		}
+	}
+	a.execute(cmds, replies, errs)
+	if h.OnResponse != nil {
+		for i := range cmds {
+			h.OnResponse(replies[i], errs[i])
+		}
+	}
+	return replies, errs
+}
+
+// execute sends the pipelined commands cmds in a single write and stores their replies and
+// errors in replies and errs.
+func (a *Session) execute(cmds []string, replies []Reply, errs []error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.ready(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+	done := make([]func(Reply, error), len(cmds))
+	for i, cmd := range cmds {
+		a.logDebug("agi command", "command", cmd)
+		done[i] = a.beginCommand(cmd)
+	}
+	var err error
+	if _, err = a.buf.WriteString(strings.Join(cmds, "\n") + "\n"); err == nil {
+		err = a.buf.Flush()
+	}
+	for i := range cmds {
+		if err == nil {
+			replies[i], errs[i] = a.parseResponse()
+			if errs[i] != nil && !isProtocolError(errs[i]) {
+				err = errs[i]
+			}
+		} else {
+			errs[i] = err
+		}
+		done[i](replies[i], errs[i])
+	}
+}
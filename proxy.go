@@ -0,0 +1,149 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// proxyV2Sig is the signature that starts a PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errNoProxyHeader is returned when a connection doesn't start with a PROXY protocol header.
+var errNoProxyHeader = errors.New("missing PROXY protocol header")
+
+// proxyListener wraps the connections accepted by a net.Listener in proxyConns.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a net.Conn that starts with a PROXY protocol header. The header is read by the
+// first call to Read or RemoteAddr, which then returns the source address it carries.
+type proxyConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once sync.Once
+	addr net.Addr
+	err  error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.addr, c.err = readProxyHeader(c.r)
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.addr != nil {
+		return c.addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r and returns the source address
+// it carries. The address is nil for connections that are not proxied, like health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1 reads a text header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 4573\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", hdr[12]>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 {
+		// LOCAL command, the connection is not proxied.
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(data) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(data[:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+	case 2: // AF_INET6
+		if len(data) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(data[:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// Test parsing of PROXY protocol headers
+func TestReadProxyHeader(t *testing.T) {
+	v2 := append([]byte(nil), proxyV2Sig...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x11, 0xdd)
+	v2local := append([]byte(nil), proxyV2Sig...)
+	v2local = append(v2local, 0x20, 0x00, 0, 0)
+	tests := []struct {
+		header []byte
+		addr   string
+		err    bool
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 4573\r\n"), "192.0.2.1:56324", false},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 4573\r\n"), "[2001:db8::1]:56324", false},
+		{[]byte("PROXY UNKNOWN\r\n"), "", false},
+		{v2, "192.0.2.1:56324", false},
+		{v2local, "", false},
+		{[]byte("PROXY TCP4 192.0.2.1\r\n"), "", true},
+		{[]byte("agi_network: yes\n"), "", true},
+	}
+	for _, tc := range tests {
+		r := bufio.NewReader(bytes.NewReader(append(tc.header, env...)))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != tc.err {
+			t.Errorf("Header %q: unexpected error: %v", tc.header, err)
+			continue
+		}
+		if tc.err {
+			continue
+		}
+		if (addr == nil && tc.addr != "") || (addr != nil && addr.String() != tc.addr) {
+			t.Errorf("Header %q: expecting address %q, got: %v", tc.header, tc.addr, addr)
+		}
+		if rest, _ := r.Peek(len(env)); !bytes.Equal(rest, env) {
+			t.Errorf("Header %q: data after the header was not preserved", tc.header)
+		}
+	}
+}
+
+// Test FastAGI sessions behind a PROXY protocol load balancer
+func TestServerProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	addr := make(chan net.Addr, 1)
+	srv := &Server{ProxyProtocol: true, Handler: HandlerFunc(func(s *Session) {
+		addr <- s.RemoteAddr()
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 4573\r\n"))
+	c.Write(env)
+	select {
+	case a := <-addr:
+		if a == nil || a.String() != "192.0.2.1:56324" {
+			t.Errorf("Unexpected remote address: %v", a)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Session was not served")
+	}
+}
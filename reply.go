@@ -0,0 +1,241 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IsSuccess reports whether the AGI command succeeded, that is Res is not negative.
+func (r Reply) IsSuccess() bool {
+	return r.Res >= 0
+}
+
+// IsError reports whether the AGI command failed, that is Res is -1.
+func (r Reply) IsError() bool {
+	return r.Res == -1
+}
+
+// AsDigit returns the DTMF digit pressed, as reported in Res by commands like WaitForDigit
+// and StreamFile, or 0 if no digit was pressed.
+func (r Reply) AsDigit() rune {
+	if r.Res > 0 {
+		return rune(r.Res)
+	}
+	return 0
+}
+
+// DigitPressed reports whether a DTMF digit was pressed, that is Res is positive.
+func (r Reply) DigitPressed() bool {
+	return r.Res > 0
+}
+
+// ReturnValue returns Dat, the additional data returned by the AGI command.
+//
+// Deprecated: For GoSub, Dat holds the completion status reported by asterisk, not the value passed
+// to Return(), which is stored in the GOSUB_RETVAL channel variable. Use Session.GoSubReturnValue.
+func (r Reply) ReturnValue() string {
+	return r.Dat
+}
+
+// jsonReply is the JSON representation of a Reply.
+type jsonReply struct {
+	Res int    `json:"res"`
+	Dat string `json:"dat"`
+}
+
+// MarshalJSON encodes r as a JSON object of the form {"res":1,"dat":"endpos=1234"}.
+func (r Reply) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonReply(r))
+}
+
+// UnmarshalJSON decodes a JSON object of the form {"res":1,"dat":"endpos=1234"} into r.
+func (r *Reply) UnmarshalJSON(data []byte) error {
+	var j jsonReply
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*r = Reply(j)
+	return nil
+}
+
+// ChannelState is the status of a channel as reported by ChannelStatus.
+type ChannelState int
+
+// Channel states.
+const (
+	ChannelDown          ChannelState = iota // Channel is down and available.
+	ChannelReserved                          // Channel is down, but reserved.
+	ChannelOffHook                           // Channel is off hook.
+	ChannelDialing                           // Digits (or equivalent) have been dialed.
+	ChannelRinging                           // Line is ringing.
+	ChannelRemoteRinging                     // Remote end is ringing.
+	ChannelUp                                // Line is up.
+	ChannelBusy                              // Line is busy.
+)
+
+var channelStates = [...]string{
+	ChannelDown:          "down",
+	ChannelReserved:      "reserved",
+	ChannelOffHook:       "off hook",
+	ChannelDialing:       "dialing",
+	ChannelRinging:       "ringing",
+	ChannelRemoteRinging: "remote ringing",
+	ChannelUp:            "up",
+	ChannelBusy:          "busy",
+}
+
+func (s ChannelState) String() string {
+	if s >= 0 && int(s) < len(channelStates) {
+		return channelStates[s]
+	}
+	return "unknown (" + strconv.Itoa(int(s)) + ")"
+}
+
+// ChannelState returns Res as a ChannelState, for use with the Reply of ChannelStatus.
+func (r Reply) ChannelState() ChannelState {
+	return ChannelState(r.Res)
+}
+
+// EndPos returns the sample offset where playback stopped, as stored in Dat by
+// StreamFile, GetOption and ControlStreamFile.
+func (r Reply) EndPos() (int, error) {
+	return strconv.Atoi(r.Dat)
+}
+
+// RecordResult holds the structured outcome of RecordFile.
+type RecordResult struct {
+	EndPos  int  // Sample offset where recording stopped.
+	DTMF    byte // DTMF digit that terminated the recording, 0 if none.
+	Timeout bool // Recording stopped because the timeout was reached.
+	Hangup  bool // Recording stopped because the channel hung up.
+}
+
+// ParseRecordResult parses the Reply of RecordFile. Dat is expected to contain an optional
+// parenthesized termination reason, like (timeout), (dtmf) or (hangup), and the endpos=NNN
+// sample offset. An error is returned if the recording failed or Dat can't be parsed.
+func ParseRecordResult(r Reply) (RecordResult, error) {
+	var rec RecordResult
+	for _, field := range strings.Fields(r.Dat) {
+		switch {
+		case strings.HasPrefix(field, "endpos="):
+			pos, err := strconv.Atoi(strings.TrimPrefix(field, "endpos="))
+			if err != nil {
+				return rec, fmt.Errorf("failed to parse recording end position: %v", err)
+			}
+			rec.EndPos = pos
+		case field == "(timeout)":
+			rec.Timeout = true
+		case field == "(hangup)":
+			rec.Hangup = true
+		case field == "(dtmf)":
+		case strings.HasPrefix(field, "(") && strings.HasSuffix(field, ")"):
+			return rec, fmt.Errorf("recording failed: %s", strings.Trim(field, "()"))
+		default:
+			return rec, fmt.Errorf("unexpected recording result: %s", r.Dat)
+		}
+	}
+	if r.Res > 0 {
+		rec.DTMF = byte(r.Res)
+	} else if r.Res < 0 && !rec.Hangup {
+		return rec, fmt.Errorf("recording failed: %s", r.Dat)
+	}
+	return rec, nil
+}
+
+// GetDataResult holds the structured outcome of GetData.
+type GetDataResult struct {
+	Digits  string // Digits received from the channel.
+	Timeout bool   // Input ended because the timeout was reached.
+}
+
+// ParseGetDataResult parses the Reply of GetData. Since Res holds the digits as a number,
+// leading zeros are lost, use GetDataTyped to get the exact digits received.
+func ParseGetDataResult(r Reply) (GetDataResult, error) {
+	if r.Res < 0 {
+		return GetDataResult{}, errors.New("failed to get data")
+	}
+	return GetDataResult{Digits: strconv.Itoa(r.Res), Timeout: r.Dat == "(timeout)"}, nil
+}
+
+// ReceiveCharResult interprets the Reply of ReceiveChar, returning the received character and
+// whether the channel supports text reception. An error is returned on failure or hang-up.
+func ReceiveCharResult(r Reply) (rune, bool, error) {
+	if r.Res < 0 {
+		return 0, true, errors.New("failed to receive char")
+	}
+	if r.Res == 0 {
+		return 0, false, nil
+	}
+	return rune(r.Res), true, nil
+}
+
+// SpeechResult holds the structured outcome of SpeechRecognize.
+type SpeechResult struct {
+	Score   int    // Confidence score of the recognized text.
+	Grammar string // Grammar that matched.
+	Text    string // Recognized text.
+}
+
+// ParseSpeechResult parses the Reply of SpeechRecognize. Dat is expected to contain space separated
+// key=value pairs, like "score=95 grammar=main text=hello". The first result is used when keys are
+// indexed, like score0 and text0, and values may be double quoted. Missing fields are left empty.
+func ParseSpeechResult(r Reply) (SpeechResult, error) {
+	var sr SpeechResult
+	if r.Res != 1 {
+		return sr, errors.New("speech recognition failed")
+	}
+	for _, field := range splitQuoted(r.Dat) {
+		ind := strings.IndexByte(field, '=')
+		if ind < 0 {
+			continue
+		}
+		key, value := strings.TrimSuffix(field[:ind], "0"), strings.Trim(field[ind+1:], "\"")
+		switch key {
+		case "score":
+			score, err := strconv.Atoi(value)
+			if err != nil {
+				return sr, fmt.Errorf("failed to parse speech score: %v", err)
+			}
+			sr.Score = score
+		case "grammar":
+			sr.Grammar = value
+		case "text":
+			sr.Text = value
+		}
+	}
+	return sr, nil
+}
+
+// splitQuoted splits s around spaces that are not enclosed in double quotes.
+func splitQuoted(s string) []string {
+	var fields []string
+	quoted := false
+	start := -1
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+			}
+			start = -1
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+	}
+	return fields
+}
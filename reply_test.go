@@ -0,0 +1,105 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Test DTMF digit helpers
+func TestAsDigit(t *testing.T) {
+	if r := (Reply{Res: 35}); r.AsDigit() != '#' || !r.DigitPressed() {
+		t.Errorf("Error getting pressed digit. Expecting: #, got: %q", r.AsDigit())
+	}
+	for _, res := range []int{0, -1} {
+		if r := (Reply{Res: res}); r.AsDigit() != 0 || r.DigitPressed() {
+			t.Errorf("Unexpected digit for Res %d: %q", res, r.AsDigit())
+		}
+	}
+}
+
+// Test deprecated ReturnValue alias
+func TestReturnValue(t *testing.T) {
+	if r := (Reply{Res: 0, Dat: "(SUCCESS)"}); r.ReturnValue() != r.Dat {
+		t.Errorf("Expecting ReturnValue to return Dat, got: %q", r.ReturnValue())
+	}
+}
+
+// Test JSON encoding of replies
+func TestReplyJSON(t *testing.T) {
+	data, err := json.Marshal(Reply{1, "endpos=1234"})
+	if err != nil || string(data) != `{"res":1,"dat":"endpos=1234"}` {
+		t.Fatalf("Error encoding reply: %s %v", data, err)
+	}
+	var r Reply
+	if err = json.Unmarshal([]byte(`{"res":-1,"dat":"(timeout)"}`), &r); err != nil || r != (Reply{-1, "(timeout)"}) {
+		t.Errorf("Error decoding reply: %+v %v", r, err)
+	}
+}
+
+// Test parsing of RecordFile results
+func TestParseRecordResult(t *testing.T) {
+	tests := []struct {
+		rep Reply
+		rec RecordResult
+		err bool
+	}{
+		{Reply{0, "(timeout) endpos=16000"}, RecordResult{EndPos: 16000, Timeout: true}, false},
+		{Reply{35, "(dtmf) endpos=8000"}, RecordResult{EndPos: 8000, DTMF: '#'}, false},
+		{Reply{-1, "(hangup) endpos=400"}, RecordResult{EndPos: 400, Hangup: true}, false},
+		{Reply{0, "endpos=1200"}, RecordResult{EndPos: 1200}, false},
+		{Reply{-1, "(writefile)"}, RecordResult{}, true},
+		{Reply{0, "endpos=foo"}, RecordResult{}, true},
+	}
+	for _, test := range tests {
+		rec, err := ParseRecordResult(test.rep)
+		if (err != nil) != test.err {
+			t.Errorf("Unexpected error parsing %v: %v", test.rep, err)
+			continue
+		}
+		if !test.err && rec != test.rec {
+			t.Errorf("Error parsing %v. Expecting: %+v, got: %+v", test.rep, test.rec, rec)
+		}
+	}
+}
+
+// Test parsing of SpeechRecognize results
+func TestParseSpeechResult(t *testing.T) {
+	tests := []struct {
+		rep Reply
+		res SpeechResult
+	}{
+		{Reply{1, "score=95 grammar=main text=hello"}, SpeechResult{95, "main", "hello"}},
+		{Reply{1, "(speech) endpos=1234 results=1 score0=80 text0=\"hello world\" grammar0=menu"}, SpeechResult{80, "menu", "hello world"}},
+		{Reply{1, "(timeout)"}, SpeechResult{}},
+	}
+	for _, test := range tests {
+		res, err := ParseSpeechResult(test.rep)
+		if err != nil {
+			t.Errorf("Error parsing %v: %v", test.rep, err)
+		}
+		if res != test.res {
+			t.Errorf("Error parsing %v. Expecting: %+v, got: %+v", test.rep, test.res, res)
+		}
+	}
+	if _, err := ParseSpeechResult(Reply{1, "score=high"}); err == nil {
+		t.Error("No error after parsing an invalid speech score")
+	}
+}
+
+// Test ReceiveChar reply interpretation
+func TestReceiveCharResult(t *testing.T) {
+	if c, ok, err := ReceiveCharResult(Reply{Res: 65}); c != 'A' || !ok || err != nil {
+		t.Errorf("Error interpreting received char: %q %v %v", c, ok, err)
+	}
+	if c, ok, err := ReceiveCharResult(Reply{Res: 0}); c != 0 || ok || err != nil {
+		t.Errorf("Error interpreting missing text support: %q %v %v", c, ok, err)
+	}
+	if _, _, err := ReceiveCharResult(Reply{Res: -1}); err == nil {
+		t.Error("ReceiveCharResult failed to detect failure")
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+//go:build !linux
+// +build !linux
+
+package agi
+
+import "syscall"
+
+// reusePortControl does nothing, SO_REUSEPORT is only supported on Linux.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
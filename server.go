@@ -0,0 +1,563 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rejectTimeout is the maximum time spent rejecting a connection exceeding MaxConcurrent.
+const rejectTimeout = time.Second
+
+// healthCheckTimeout is the maximum time a session may take to reply to a health check ping,
+// shorter health check intervals are used as the timeout instead.
+const healthCheckTimeout = 5 * time.Second
+
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe methods after a call to Shutdown.
+var ErrServerClosed = errors.New("agi: Server closed")
+
+// A Handler responds to a FastAGI session.
+// ServeAGI is called with an initialized Session and the connection is closed when it returns.
+type Handler interface {
+	ServeAGI(*Session)
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as FastAGI handlers.
+type HandlerFunc func(*Session)
+
+// ServeAGI calls f(s).
+func (f HandlerFunc) ServeAGI(s *Session) {
+	f(s)
+}
+
+// Server defines the parameters for running a FastAGI server.
+type Server struct {
+	Addr         string         // TCP address to listen on, ":4573" if empty.
+	Handler      Handler        // Handler to invoke for each session, DefaultMux if nil.
+	TLSConfig    *tls.Config    // Optional TLS configuration, used by ListenAndServeTLS.
+	ClientCAs    *x509.CertPool // If set, TLS clients must present a certificate signed by one of these CAs.
+	ReadTimeout  time.Duration  // Maximum duration of each read from the connection, zero means no timeout.
+	WriteTimeout time.Duration  // Maximum duration of each write to the connection, zero means no timeout.
+	ErrorLog     *log.Logger    // Logger for connection errors, if nil the log package's standard logger is used.
+
+	UnixSocketMode   os.FileMode   // File permissions of the ListenAndServeUnix socket, 0660 if zero.
+	Metrics          Metrics       // Optional collector of session and command measurements.
+	HandshakeTimeout time.Duration // Maximum duration for receiving the AGI environment, zero means no timeout.
+	IdleTimeout      time.Duration // Maximum duration between AGI commands of a session, zero means no timeout.
+
+	// HealthCheckInterval, if positive, makes the server Ping every active session at this interval,
+	// closing the connections of sessions that fail to reply within the interval, or 5 seconds
+	// if that is shorter.
+	HealthCheckInterval time.Duration
+
+	// ProxyProtocol enables the PROXY protocol, v1 or v2, as sent by load balancers in front of
+	// the server. Every connection must then start with a PROXY header, its source address is
+	// reported by Session.RemoteAddr.
+	ProxyProtocol bool
+
+	// ReusePort sets SO_REUSEPORT on the listening socket of ListenAndServe and ListenAndServeTLS,
+	// allowing a new server process to bind the same port before the old one exits, for
+	// zero-downtime restarts. It is only supported on Linux and ignored on other platforms.
+	ReusePort bool
+
+	// TCPKeepAlive sets the idle time before TCP keep-alive probes are sent on accepted TCP
+	// connections, TCP_KEEPIDLE on Linux. Zero or a negative value disables keep-alive probes,
+	// overriding the net package default. Keep-alive prevents connections from being silently
+	// dropped by the network, while IdleTimeout terminates sessions that are still connected but
+	// logically idle.
+	TCPKeepAlive time.Duration
+
+	// MaxConcurrent limits the number of concurrent sessions, zero means no limit. Connections
+	// exceeding the limit are sent a HANGUP command and closed right away.
+	MaxConcurrent int
+	// OnSessionRejected, if set, is called with each connection rejected due to MaxConcurrent,
+	// before it gets closed. It runs in its own goroutine and the connection is closed after
+	// one second even if it hasn't returned.
+	OnSessionRejected func(net.Conn)
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]struct{}
+	sessions   map[*Session]net.Conn // Initialized sessions, for health checks.
+	checker    bool                  // Health check goroutine is running.
+	wg         sync.WaitGroup        // Active sessions.
+	inShutdown int32                 // Atomic shutdown flag.
+}
+
+// ListenAndServe listens on the TCP network address srv.Addr and then calls Serve
+// to handle incoming FastAGI connections.
+func (srv *Server) ListenAndServe() error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	ln, err := srv.listenTCP()
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// listenTCP listens on the TCP network address srv.Addr, setting SO_REUSEPORT if srv.ReusePort is set.
+func (srv *Server) listenTCP() (net.Listener, error) {
+	var lc net.ListenConfig
+	if srv.ReusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", srv.address())
+}
+
+// ListenAndServeTLS acts like ListenAndServe except that it expects TLS connections.
+// The certificate and matching private key files must be provided unless srv.TLSConfig
+// already contains certificates. If srv.ClientCAs is set, Asterisk instances are
+// required to authenticate with a client certificate signed by one of those CAs.
+// The Env["network"] variable of TLS sessions is set to "tls".
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	config := new(tls.Config)
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	hasCert := len(config.Certificates) > 0 || config.GetCertificate != nil
+	if !hasCert || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if srv.ClientCAs != nil {
+		config.ClientCAs = srv.ClientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ln, err := srv.listenTCP()
+	if err != nil {
+		return err
+	}
+	ln = keepAliveListener{ln, srv.TCPKeepAlive}
+	if srv.ProxyProtocol {
+		// The PROXY header precedes the TLS handshake.
+		ln = proxyListener{ln}
+	}
+	return srv.serve(tls.NewListener(ln, config))
+}
+
+// ListenAndServeUnix listens on the Unix domain socket at path and then calls Serve to handle
+// incoming FastAGI connections. Any stale socket file at path is removed before binding and the
+// socket permissions are set to srv.UnixSocketMode.
+func (srv *Server) ListenAndServeUnix(path string) error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	mode := srv.UnixSocketMode
+	if mode == 0 {
+		mode = 0660
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Serve accepts incoming connections on the Listener l, creating a new Session for each one.
+// Every session is initialized and then handled in its own goroutine by srv.Handler.
+// Serve always returns a non-nil error, after Shutdown it returns ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	l = keepAliveListener{l, srv.TCPKeepAlive}
+	if srv.ProxyProtocol {
+		l = proxyListener{l}
+	}
+	return srv.serve(l)
+}
+
+func (srv *Server) serve(l net.Listener) error {
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+	if srv.HealthCheckInterval > 0 {
+		srv.mu.Lock()
+		if !srv.checker {
+			srv.checker = true
+			go srv.healthCheck()
+		}
+		srv.mu.Unlock()
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if err := srv.trackConn(conn, true); err != nil {
+			if err == errTooManySessions {
+				go srv.reject(conn)
+				continue
+			}
+			conn.Close()
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+// reject hangs up and closes a connection exceeding MaxConcurrent. The connection is closed
+// after rejectTimeout even if OnSessionRejected or the HANGUP write are still blocked.
+func (srv *Server) reject(c net.Conn) {
+	// The deadline also bounds reading the PROXY header for RemoteAddr.
+	c.SetDeadline(time.Now().Add(rejectTimeout))
+	t := time.AfterFunc(rejectTimeout, func() { c.Close() })
+	defer t.Stop()
+	if srv.OnSessionRejected != nil {
+		srv.OnSessionRejected(c)
+	}
+	c.Write([]byte("HANGUP\n"))
+	srv.logf("agi: connection from %v rejected, limit of %d concurrent sessions reached", c.RemoteAddr(), srv.MaxConcurrent)
+	c.Close()
+}
+
+// ActiveSessions returns the number of connections currently being served.
+func (srv *Server) ActiveSessions() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns)
+}
+
+// healthCheck pings the active sessions every HealthCheckInterval until the server shuts down.
+func (srv *Server) healthCheck() {
+	t := time.NewTicker(srv.HealthCheckInterval)
+	defer t.Stop()
+	for range t.C {
+		if srv.shuttingDown() {
+			srv.mu.Lock()
+			srv.checker = false
+			srv.mu.Unlock()
+			return
+		}
+		srv.mu.Lock()
+		for a, c := range srv.sessions {
+			// Sessions busy with a long running command may delay the ping, skip those still being checked.
+			if atomic.CompareAndSwapInt32(&a.checking, 0, 1) {
+				go srv.checkSession(a, c)
+			}
+		}
+		srv.mu.Unlock()
+	}
+}
+
+// checkSession pings a and closes its connection c if it fails to reply.
+func (srv *Server) checkSession(a *Session, c net.Conn) {
+	defer atomic.StoreInt32(&a.checking, 0)
+	timeout := srv.HealthCheckInterval
+	if timeout > healthCheckTimeout {
+		timeout = healthCheckTimeout
+	}
+	err := a.Ping(timeout)
+	if err == nil {
+		return
+	}
+	srv.mu.Lock()
+	_, active := srv.sessions[a]
+	delete(srv.sessions, a)
+	srv.mu.Unlock()
+	if !active {
+		// The session ended while being checked.
+		return
+	}
+	if srv.Metrics != nil {
+		srv.Metrics.SessionTimedOut()
+	}
+	srv.logf("agi: session from %v closed after failing health check: %v", c.RemoteAddr(), err)
+	c.Close()
+}
+
+// trackSession adds or removes the initialized session a on connection c from the set of health checked sessions.
+func (srv *Server) trackSession(a *Session, c net.Conn, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.sessions == nil {
+			srv.sessions = make(map[*Session]net.Conn)
+		}
+		srv.sessions[a] = c
+	} else {
+		delete(srv.sessions, a)
+	}
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners, rejecting new connections,
+// and then waits for the active sessions to finish normally. If ctx expires before that,
+// Shutdown returns ctx.Err().
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	err := srv.closeListenersLocked()
+	srv.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all listeners and the connections of all active sessions,
+// causing any further AGI commands of those sessions to fail. The returned error wraps the errors
+// of every listener and connection that failed to close. For a graceful shutdown use Shutdown.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	var errs []error
+	if err := srv.closeListenersLocked(); err != nil {
+		errs = append(errs, err)
+	}
+	for c := range srv.conns {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (srv *Server) closeListenersLocked() error {
+	var errs []error
+	for l := range srv.listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(srv.listeners, l)
+	}
+	return joinErrors(errs)
+}
+
+// serveConn initializes an AGI session on c and passes it to the handler.
+func (srv *Server) serveConn(c net.Conn) {
+	defer srv.trackConn(c, false)
+	defer c.Close()
+	var rw net.Conn = c
+	if srv.ReadTimeout > 0 || srv.WriteTimeout > 0 {
+		rw = &timeoutConn{Conn: c, readTimeout: srv.ReadTimeout, writeTimeout: srv.WriteTimeout}
+	}
+	if srv.Metrics != nil {
+		srv.Metrics.SessionStarted()
+		defer srv.Metrics.SessionEnded()
+	}
+	a := New()
+	a.metrics = srv.Metrics
+	if srv.HandshakeTimeout > 0 {
+		rw.SetDeadline(time.Now().Add(srv.HandshakeTimeout))
+	}
+	if err := a.InitConn(rw); err != nil {
+		srv.logf("agi: session initialization from %v failed: %v", c.RemoteAddr(), err)
+		return
+	}
+	if srv.HandshakeTimeout > 0 {
+		rw.SetDeadline(time.Time{})
+	}
+	if _, ok := c.(*tls.Conn); ok {
+		a.Env["network"] = "tls"
+	}
+	handler := srv.Handler
+	if handler == nil {
+		handler = DefaultMux
+	}
+	if srv.HealthCheckInterval > 0 {
+		srv.trackSession(a, c, true)
+		defer srv.trackSession(a, c, false)
+	}
+	var idled int32
+	if srv.IdleTimeout > 0 {
+		a.idleTimeout = srv.IdleTimeout
+		a.idleTimer = time.AfterFunc(srv.IdleTimeout, func() {
+			atomic.StoreInt32(&idled, 1)
+			// Health checks failing on the closed connection are not timeouts.
+			srv.trackSession(a, c, false)
+			c.Close()
+		})
+	}
+	defer a.close()
+	handler.ServeAGI(a)
+	if atomic.LoadInt32(&idled) != 0 {
+		srv.logf("agi: session from %v closed after being idle for %v", c.RemoteAddr(), srv.IdleTimeout)
+	}
+}
+
+// NewTLSSession completes the TLS handshake on c and returns a new Session initialized
+// from the AGI environment sent over it. The Env["network"] variable is set to "tls".
+func NewTLSSession(c *tls.Conn) (*Session, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	a := New()
+	if err := a.InitConn(c); err != nil {
+		return nil, err
+	}
+	a.Env["network"] = "tls"
+	return a, nil
+}
+
+func (srv *Server) address() string {
+	if srv.Addr == "" {
+		return ":4573"
+	}
+	return srv.Addr
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// errTooManySessions is returned by trackConn when MaxConcurrent sessions are already active.
+var errTooManySessions = errors.New("agi: too many concurrent sessions")
+
+// trackConn adds or removes c from the set of active connections, keeping count of the active sessions.
+// When adding a connection it returns ErrServerClosed if the server is shutting down and
+// errTooManySessions if MaxConcurrent is reached.
+func (srv *Server) trackConn(c net.Conn, add bool) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.shuttingDown() {
+			return ErrServerClosed
+		}
+		if srv.MaxConcurrent > 0 && len(srv.conns) >= srv.MaxConcurrent {
+			return errTooManySessions
+		}
+		if srv.conns == nil {
+			srv.conns = make(map[net.Conn]struct{})
+		}
+		srv.conns[c] = struct{}{}
+		srv.wg.Add(1)
+	} else {
+		delete(srv.conns, c)
+		srv.wg.Done()
+	}
+	return nil
+}
+
+// trackListener adds or removes l from the set of active listeners.
+// It returns false when trying to add a listener to a server that is shutting down.
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]struct{})
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// keepAliveListener sets the TCP keep-alive of accepted TCP connections, see Server.TCPKeepAlive.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		if l.period > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.period)
+		} else {
+			tc.SetKeepAlive(false)
+		}
+	}
+	return c, nil
+}
+
+// timeoutConn is a net.Conn that sets a deadline before every read and write.
+// Explicitly set deadlines are honoured when they expire earlier than the timeouts.
+type timeoutConn struct {
+	net.Conn
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(earliest(time.Now().Add(c.readTimeout), c.readDeadline))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(earliest(time.Now().Add(c.writeTimeout), c.writeDeadline))
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.readDeadline, c.writeDeadline = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// earliest returns the earliest of t and the optional deadline d.
+func earliest(t, d time.Time) time.Time {
+	if !d.IsZero() && d.Before(t) {
+		return d
+	}
+	return t
+}
@@ -0,0 +1,787 @@
+// Copyright (C) 2013 - 2015, Lefteris Zafiris <zaf@fastmail.com>
+// This program is free software, distributed under the terms of
+// the BSD 3-Clause License. See the LICENSE file
+// at the top of the source tree.
+
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test a FastAGI session served by Server
+func TestServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	release := make(chan struct{})
+	srv := &Server{Handler: HandlerFunc(func(s *Session) {
+		r, err := s.Verbose("Hello World")
+		if err != nil || r.Res != 1 {
+			t.Errorf("Failed to send AGI command: %v", err)
+		}
+		<-release
+	})}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+	c.Write(env)
+	rd := bufio.NewReader(c)
+	cmd, err := rd.ReadString(10)
+	if err != nil {
+		t.Fatalf("Failed to read AGI command: %v", err)
+	}
+	if cmd != "VERBOSE \"Hello World\"\n" {
+		t.Errorf("Received unexpected AGI command: %s", cmd)
+	}
+	c.Write([]byte("200 result=1\n"))
+
+	// Shutdown must wait for the active session.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned before the session ended: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned unexpected error: %v", err)
+	}
+	close(release)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+}
+
+// Test FastAGI over a Unix domain socket
+func TestServerUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agi.sock")
+	srv := &Server{Handler: HandlerFunc(func(s *Session) {
+		s.Verbose("Hello World")
+	})}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServeUnix(path) }()
+	var c net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("Unexpected socket permissions: %v %v", fi.Mode(), err)
+	}
+	c.Write(env)
+	cmd, err := bufio.NewReader(c).ReadString(10)
+	if err != nil || cmd != "VERBOSE \"Hello World\"\n" {
+		t.Errorf("Received unexpected AGI command: %s %v", cmd, err)
+	}
+	c.Write([]byte("200 result=1\n"))
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned unexpected error: %v", err)
+	}
+}
+
+// Test immediate termination of active sessions
+func TestServerClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	sent := make(chan struct{})
+	result := make(chan error, 1)
+	srv := &Server{Handler: HandlerFunc(func(s *Session) {
+		close(sent)
+		_, err := s.Verbose("Hello World")
+		result <- err
+	})}
+	go srv.Serve(ln)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+	c.Write(env)
+	<-sent
+	srv.Close()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("AGI command succeeded after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Session still active after Close")
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown after Close failed: %v", err)
+	}
+}
+
+// Test collection of all connection close errors
+func TestServerCloseErrors(t *testing.T) {
+	srv := &Server{}
+	errs := []error{errors.New("close error 1"), errors.New("close error 2")}
+	for _, err := range errs {
+		if err := srv.trackConn(closeErrConn{err: err}, true); err != nil {
+			t.Fatalf("Failed to track connection: %v", err)
+		}
+	}
+	err := srv.Close()
+	for _, e := range errs {
+		if err == nil || !strings.Contains(err.Error(), e.Error()) {
+			t.Errorf("Expecting Close error to include %q, got: %v", e, err)
+		}
+	}
+}
+
+// closeErrConn is a net.Conn that fails to close with err.
+type closeErrConn struct {
+	net.Conn
+	err error
+}
+
+func (c closeErrConn) Close() error {
+	return c.err
+}
+
+// Test closing of connections that stall before sending the AGI environment
+func TestServerHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	handled := make(chan struct{}, 1)
+	srv := &Server{
+		Handler:          HandlerFunc(func(s *Session) { handled <- struct{}{} }),
+		HandshakeTimeout: 50 * time.Millisecond,
+		ErrorLog:         log.New(ioutil.Discard, "", 0),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expecting connection to be closed, got: %v", err)
+	}
+	select {
+	case <-handled:
+		t.Error("Handler called for a stalled session")
+	default:
+	}
+}
+
+// Test binding of the same port by multiple servers with ReusePort
+func TestServerReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on Linux")
+	}
+	srv := &Server{Addr: "127.0.0.1:0", ReusePort: true}
+	ln1, err := srv.listenTCP()
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	defer ln1.Close()
+	srv.Addr = ln1.Addr().String()
+	ln2, err := srv.listenTCP()
+	if err != nil {
+		t.Fatalf("Failed to bind the same port: %v", err)
+	}
+	ln2.Close()
+	srv.ReusePort = false
+	if ln3, err := srv.listenTCP(); err == nil {
+		ln3.Close()
+		t.Error("Expecting bind to fail without ReusePort")
+	}
+}
+
+// Test rejection of connections exceeding MaxConcurrent
+func TestServerMaxConcurrent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	rejected := make(chan net.Conn, 1)
+	srv := &Server{
+		Handler:           HandlerFunc(func(s *Session) {}),
+		MaxConcurrent:     1,
+		OnSessionRejected: func(c net.Conn) { rejected <- c },
+		ErrorLog:          log.New(ioutil.Discard, "", 0),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	// The first connection stalls before sending the environment, keeping its slot busy.
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c1.Close()
+	for i := 0; srv.ActiveSessions() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("Expecting 1 active session, got: %d", srv.ActiveSessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := ioutil.ReadAll(c2)
+	if err != nil || string(b) != "HANGUP\n" {
+		t.Errorf("Expecting HANGUP and close, got: %q, %v", b, err)
+	}
+	select {
+	case <-rejected:
+	default:
+		t.Error("OnSessionRejected not called")
+	}
+	if n := srv.ActiveSessions(); n != 1 {
+		t.Errorf("Expecting 1 active session, got: %d", n)
+	}
+}
+
+// Test that rejecting connections doesn't block the server or the rejected connections
+func TestServerRejectBlocked(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	srv := &Server{
+		Handler:       HandlerFunc(func(s *Session) {}),
+		MaxConcurrent: 1,
+		ProxyProtocol: true,
+		OnSessionRejected: func(c net.Conn) {
+			// Blocks reading the PROXY header that is never sent, then blocks forever.
+			c.RemoteAddr()
+			<-stop
+		},
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c1.Close()
+	for i := 0; srv.ActiveSessions() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("Expecting 1 active session, got: %d", srv.ActiveSessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
+		}
+		defer c.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.SetReadDeadline(time.Now().Add(3 * time.Second))
+			if _, err := ioutil.ReadAll(c); err != nil {
+				t.Errorf("Rejected connection not closed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Rejected connections closed after: %v", d)
+	}
+}
+
+// Test closing of sessions that send no AGI commands for longer than IdleTimeout
+func TestServerIdleTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	var logBuf bytes.Buffer
+	var logMu sync.Mutex
+	result := make(chan error, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			if _, err := s.Noop(); err != nil {
+				result <- err
+				return
+			}
+			time.Sleep(200 * time.Millisecond)
+			_, err := s.Noop()
+			result <- err
+		}),
+		IdleTimeout: 50 * time.Millisecond,
+		ErrorLog:    log.New(syncWriter{&logMu, &logBuf}, "", 0),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+	c.Write(env)
+	r := bufio.NewReader(c)
+	if _, err := r.ReadString(10); err != nil {
+		t.Fatalf("Failed to read command: %v", err)
+	}
+	c.Write([]byte("200 result=0\n"))
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("Expecting command of an idle session to fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for handler")
+	}
+	time.Sleep(50 * time.Millisecond)
+	logMu.Lock()
+	defer logMu.Unlock()
+	if !strings.Contains(logBuf.String(), "idle") {
+		t.Errorf("Expecting idle timeout to be logged, got: %q", logBuf.String())
+	}
+}
+
+// Test closing of sessions that fail health checks
+func TestServerHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	m := new(testMetrics)
+	release := make(chan struct{})
+	srv := &Server{
+		Handler:             HandlerFunc(func(s *Session) { <-release }),
+		HealthCheckInterval: 50 * time.Millisecond,
+		Metrics:             m,
+		ErrorLog:            log.New(ioutil.Discard, "", 0),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	defer close(release)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+	c.Write(env)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := ioutil.ReadAll(c)
+	if err != nil || string(b) != "NOOP\n" {
+		t.Errorf("Expecting a NOOP ping and close, got: %q, %v", b, err)
+	}
+	if n := atomic.LoadInt32(&m.timedOut); n != 1 {
+		t.Errorf("Expecting 1 timed out session, got: %d", n)
+	}
+}
+
+// Test that health checks don't keep idle sessions alive or count as commands
+func TestServerHealthCheckIdle(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	m := new(testMetrics)
+	sessions := make(chan *Session, 1)
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			sessions <- s
+			<-release
+		}),
+		HealthCheckInterval: 20 * time.Millisecond,
+		IdleTimeout:         200 * time.Millisecond,
+		Metrics:             m,
+		ErrorLog:            log.New(ioutil.Discard, "", 0),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	defer close(release)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+	c.Write(env)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(c)
+	pings := 0
+	for {
+		line, err := r.ReadString(10)
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("Expecting idle session to be closed, got: %v", err)
+			}
+			break
+		}
+		if line == "NOOP\n" {
+			pings++
+			c.Write([]byte("200 result=0\n"))
+		}
+	}
+	if pings < 2 {
+		t.Errorf("Expecting multiple health check pings, got: %d", pings)
+	}
+	if n := (<-sessions).CommandCount(); n != 0 {
+		t.Errorf("Expecting health check pings not to be counted, got: %d", n)
+	}
+	if n := atomic.LoadInt32(&m.timedOut); n != 0 {
+		t.Errorf("Expecting no timed out sessions, got: %d", n)
+	}
+}
+
+// testMetrics counts timed out sessions.
+type testMetrics struct {
+	timedOut int32
+}
+
+func (m *testMetrics) SessionStarted()                        {}
+func (m *testMetrics) SessionEnded()                          {}
+func (m *testMetrics) CommandCompleted(string, time.Duration) {}
+func (m *testMetrics) HangupReceived()                        {}
+func (m *testMetrics) SessionTimedOut()                       { atomic.AddInt32(&m.timedOut, 1) }
+
+// syncWriter serializes writes to w.
+type syncWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// Test the FastAGI client connecting to Server
+func TestDialFastAGI(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	received := make(chan map[string]string, 1)
+	result := make(chan Reply, 1)
+	srv := &Server{Handler: HandlerFunc(func(s *Session) {
+		received <- s.Env
+		r, _ := s.Verbose("Hello World")
+		result <- r
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	env := map[string]string{"request": "agi://127.0.0.1/test", "agi_channel": "SIP/1234-00000000"}
+	for i := 0; i < envMin; i++ {
+		env["arg_"+strconv.Itoa(i+1)] = "foo"
+	}
+	c, err := DialFastAGI(context.Background(), ln.Addr().String(), env)
+	if err != nil {
+		t.Fatalf("Failed to dial FastAGI server: %v", err)
+	}
+	defer c.Close()
+	select {
+	case got := <-received:
+		if got["request"] != env["request"] || got["channel"] != "SIP/1234-00000000" || len(got) != len(env) {
+			t.Errorf("Server received unexpected environment: %v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Server did not receive the AGI environment")
+	}
+	if c.Env["channel"] != "SIP/1234-00000000" {
+		t.Errorf("Unexpected client environment: %v", c.Env)
+	}
+	cmd, err := c.ReadCommand()
+	if err != nil || cmd != "VERBOSE \"Hello World\"" {
+		t.Fatalf("Unexpected AGI command: %q %v", cmd, err)
+	}
+	if err = c.WriteReply(Reply{Res: 1, Dat: "(ok)"}); err != nil {
+		t.Fatalf("Failed to write reply: %v", err)
+	}
+	if r := <-result; r.Res != 1 || r.Dat != "(ok)" {
+		t.Errorf("Server received unexpected reply: %+v", r)
+	}
+	if _, err = c.ReadCommand(); err != io.EOF {
+		t.Errorf("Expecting EOF after the session ended, got: %v", err)
+	}
+	if err = c.Close(); err != nil {
+		t.Errorf("Failed to close client: %v", err)
+	}
+}
+
+// Test cancellation of a FastAGI client exchange through its context
+func TestDialFastAGIContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accepts the connection but never sends a command.
+		if c, err := ln.Accept(); err == nil {
+			defer c.Close()
+			io.Copy(ioutil.Discard, c)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := DialFastAGI(ctx, ln.Addr().String(), map[string]string{"request": "agi://127.0.0.1/test"})
+	if err != nil {
+		t.Fatalf("Failed to dial FastAGI server: %v", err)
+	}
+	defer c.Close()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ReadCommand()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expecting context.Canceled error, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadCommand still blocked after context cancellation")
+	}
+	if err = c.WriteReply(Reply{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expecting context.Canceled error, got: %v", err)
+	}
+}
+
+// Test deadline propagation to connections of sessions created with InitConn
+func TestInitConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c2.Write(env)
+	a := New()
+	if err := a.InitConn(c1); err != nil {
+		t.Fatalf("Failed to initialize new AGI session: %v", err)
+	}
+	if a.conn != c1 || a.dl != nil {
+		t.Fatal("Connection was not stored")
+	}
+	a.SetCommandTimeout(20 * time.Millisecond)
+	go io.Copy(ioutil.Discard, c2)
+	if _, err := a.Answer(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expecting deadline exceeded error, got: %v", err)
+	}
+	if a.dl != nil {
+		t.Error("Deadline was not set on the connection")
+	}
+}
+
+// testCerts holds the certificates of a test CA, a server and a client signed by it.
+type testCerts struct {
+	pool   *x509.CertPool
+	server tls.Certificate
+	client tls.Certificate
+}
+
+// newTestCerts generates a self-signed CA and server and client certificates signed by it.
+func newTestCerts(t *testing.T) testCerts {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "agi test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	if ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	issue := func(serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "agi test"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Failed to create certificate: %v", err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return testCerts{
+		pool:   pool,
+		server: issue(2, x509.ExtKeyUsageServerAuth),
+		client: issue(3, x509.ExtKeyUsageClientAuth),
+	}
+}
+
+// listenAndServeTLS starts srv.ListenAndServeTLS on a free local port and returns its address.
+func listenAndServeTLS(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	srv.Addr = ln.Addr().String()
+	ln.Close()
+	go srv.ListenAndServeTLS("", "")
+	return srv.Addr
+}
+
+// dialTLS connects to the TLS server at addr, retrying until it is listening.
+func dialTLS(t *testing.T, addr string, config *tls.Config) *tls.Conn {
+	var c *tls.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if c, err = tls.Dial("tcp", addr, config); err == nil {
+			return c
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Failed to connect to server: %v", err)
+	return nil
+}
+
+// Test FastAGI over TLS
+func TestServerTLS(t *testing.T) {
+	certs := newTestCerts(t)
+	network := make(chan string, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			network <- s.Env["network"]
+			s.Verbose("Hello World")
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certs.server}},
+	}
+	defer srv.Close()
+	c := dialTLS(t, listenAndServeTLS(t, srv), &tls.Config{RootCAs: certs.pool})
+	defer c.Close()
+	c.Write(env)
+	cmd, err := bufio.NewReader(c).ReadString(10)
+	if err != nil || cmd != "VERBOSE \"Hello World\"\n" {
+		t.Errorf("Received unexpected AGI command: %s %v", cmd, err)
+	}
+	c.Write([]byte("200 result=1\n"))
+	if n := <-network; n != "tls" {
+		t.Errorf("Expecting network: tls, got: %s", n)
+	}
+}
+
+// Test FastAGI over TLS with client certificate authentication
+func TestServerTLSClientCAs(t *testing.T) {
+	certs := newTestCerts(t)
+	handled := make(chan struct{}, 2)
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			handled <- struct{}{}
+			s.Verbose("Hello World")
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certs.server}},
+		ClientCAs: certs.pool,
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}
+	defer srv.Close()
+	addr := listenAndServeTLS(t, srv)
+	c := dialTLS(t, addr, &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.client}})
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write(env)
+	cmd, err := bufio.NewReader(c).ReadString(10)
+	if err != nil || cmd != "VERBOSE \"Hello World\"\n" {
+		t.Errorf("Received unexpected AGI command: %s %v", cmd, err)
+	}
+	c.Write([]byte("200 result=1\n"))
+	<-handled
+	// Without a client certificate the server aborts the handshake, depending on the TLS
+	// version the client notices while dialing or on its first read.
+	c2, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: certs.pool})
+	if err == nil {
+		defer c2.Close()
+		c2.SetDeadline(time.Now().Add(2 * time.Second))
+		c2.Write(env)
+		if _, err = bufio.NewReader(c2).ReadString(10); err == nil {
+			t.Error("Expecting connection without client certificate to fail")
+		}
+	}
+	select {
+	case <-handled:
+		t.Error("Handler called for a client without certificate")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Test TLS session initialization with NewTLSSession
+func TestNewTLSSession(t *testing.T) {
+	certs := newTestCerts(t)
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	go func() {
+		c := tls.Client(cc, &tls.Config{RootCAs: certs.pool, ServerName: "127.0.0.1"})
+		if c.Handshake() == nil {
+			c.Write(env)
+		}
+	}()
+	a, err := NewTLSSession(tls.Server(sc, &tls.Config{Certificates: []tls.Certificate{certs.server}}))
+	if err != nil {
+		t.Fatalf("Failed to initialize TLS AGI session: %v", err)
+	}
+	if a.Env["network"] != "tls" || a.Env["channel"] != "SIP/1234-00000000" {
+		t.Errorf("Unexpected TLS session environment: %v", a.Env)
+	}
+}